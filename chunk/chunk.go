@@ -2,109 +2,135 @@ package chunk
 
 import (
 	"bytes"
-	"errors"
-	"fmt"
+	"encoding/binary"
 	"io"
-	"sync"
 
 	"github.com/Tnze/go-mc/nbt"
-	"github.com/klauspost/compress/gzip"
-	"github.com/klauspost/compress/zlib"
 )
 
 type RegionLevel_1_8_8 struct {
 	Level Chunk_1_8_8
+	Extra Extra `nbt:"-"`
 }
 
 type Chunk_1_8_8 struct {
 	Entities         nbt.RawMessage
-	Sections         []Section
+	Sections         []Section `nbt:",omitempty"`
 	TileEntities     nbt.RawMessage
 	InhabitedTime    int64
 	LastUpdate       int64
 	LightPopulated   byte
 	TerrainPopulated byte
-	V                int32 `nbt:",omitempty"`
-	XPos             int32 `nbt:"xPos"`
-	ZPos             int32 `nbt:"zPos"`
+	V                int32  `nbt:",omitempty"`
+	XPos             *int32 `nbt:"xPos"`
+	ZPos             *int32 `nbt:"zPos"`
 	Biomes           []byte
 	HeightMap        []int32
 
+	// Extra keeps the unknown tags of the Level compound
+	Extra Extra `nbt:"-"`
+	// rootExtra keeps the unknown tags next to the Level compound
+	rootExtra Extra
+
 	sectionCache []*Section
 }
 
+type regionLevelFields_1_8_8 RegionLevel_1_8_8
+type chunkFields_1_8_8 Chunk_1_8_8
+
 type Section struct {
 	Y          byte
 	SkyLight   []byte `nbt:",omitempty"`
-	BlockLight []byte
+	BlockLight []byte `nbt:",omitempty"`
 	Blocks     []byte
 	Data       []byte
 	Add        []byte `nbt:",omitempty"`
-}
 
-func (c *Chunk_1_8_8) Load(data []byte) (err error) {
-	var r io.Reader = bytes.NewReader(data[1:])
+	// Extra keeps the unknown tags of the section
+	Extra Extra `nbt:"-"`
+}
 
-	switch data[0] {
-	default:
-		err = errors.New("unknown compression")
-	case 1:
-		reader := gzipReaderPool.Get()
-		if reader == nil {
-			r, err = gzip.NewReader(r)
-		} else {
-			r = reader.(*gzip.Reader)
-			err = reader.(*gzip.Reader).Reset(r)
-		}
-		defer func() {
-			gzipReaderPool.Put(reader)
-		}()
-	case 2:
-		reader := zlibReaderPool.Get()
-		if reader == nil {
-			r, err = zlib.NewReader(r)
-		} else {
-			r = reader.(io.Reader)
-			err = reader.(zlib.Resetter).Reset(r, nil)
-		}
-		defer func() {
-			zlibReaderPool.Put(reader)
-		}()
-	}
+type sectionFields_1_8_8 Section
 
+func (c *Chunk_1_8_8) Load(data []byte) error {
+	raw, err := decompress(data)
 	if err != nil {
 		return err
 	}
+	return c.decode(raw)
+}
 
+func (c *Chunk_1_8_8) decode(raw []byte) error {
 	level := RegionLevel_1_8_8{Level: *c}
-	_, err = nbt.NewDecoder(r).Decode(&level)
+	err := nbt.Unmarshal(raw, &level)
 	*c = level.Level
-	return
+	c.rootExtra = level.Extra
+	return err
 }
 
 func (c *Chunk_1_8_8) Save() ([]byte, error) {
-	var buf bytes.Buffer
-	buf.WriteByte(2)
+	return encodeSector(RegionLevel_1_8_8{Level: *c, Extra: c.rootExtra})
+}
 
-	var w io.Writer
-	writer := zlibWriterPool.Get()
-	if writer == nil {
-		w = zlib.NewWriter(&buf)
-	} else {
-		w = writer.(*zlib.Writer)
-		writer.(*zlib.Writer).Reset(&buf)
-	}
-	defer func() {
-		zlibWriterPool.Put(w)
-	}()
+func (c *Chunk_1_8_8) Pos() (x, z int, ok bool) {
+	return chunkPos(c.XPos, c.ZPos)
+}
 
-	level := RegionLevel_1_8_8{Level: *c}
-	err := nbt.NewEncoder(w).Encode(level, "")
-	if err != nil {
-		return nil, fmt.Errorf("write chunk: %w", err)
+func (c *Chunk_1_8_8) Inhabited() int64 {
+	return c.InhabitedTime
+}
+
+func (c *Chunk_1_8_8) HasTileEntities() bool {
+	return len(c.TileEntities.Data) > 5
+}
+
+func (l *RegionLevel_1_8_8) UnmarshalNBT(tagType byte, r nbt.DecoderReader) (err error) {
+	l.Extra, err = unmarshalCompound(tagType, r, (*regionLevelFields_1_8_8)(l))
+	return
+}
+
+func (l RegionLevel_1_8_8) TagType() byte {
+	return nbt.TagCompound
+}
+
+func (l RegionLevel_1_8_8) MarshalNBT(w io.Writer) error {
+	return marshalCompound(w, regionLevelFields_1_8_8(l), l.Extra)
+}
+
+func (c *Chunk_1_8_8) UnmarshalNBT(tagType byte, r nbt.DecoderReader) (err error) {
+	c.Extra, err = unmarshalCompound(tagType, r, (*chunkFields_1_8_8)(c))
+	return
+}
+
+func (c Chunk_1_8_8) TagType() byte {
+	return nbt.TagCompound
+}
+
+func (c Chunk_1_8_8) MarshalNBT(w io.Writer) error {
+	// The nbt package does not use custom marshalers for list elements, so
+	// the sections are written by hand to keep their unknown tags
+	var sections bytes.Buffer
+	sections.WriteByte(nbt.TagCompound)
+	_ = binary.Write(&sections, binary.BigEndian, int32(len(c.Sections)))
+	for i := range c.Sections {
+		if err := marshalCompound(&sections, sectionFields_1_8_8(c.Sections[i]), c.Sections[i].Extra); err != nil {
+			return err
+		}
 	}
-	err = w.(*zlib.Writer).Flush()
-	return buf.Bytes(), err
+	extra := make(Extra, len(c.Extra)+1)
+	for name, tag := range c.Extra {
+		extra[name] = tag
+	}
+	extra["Sections"] = nbt.RawMessage{Type: nbt.TagList, Data: sections.Bytes()}
+
+	fields := chunkFields_1_8_8(c)
+	fields.Sections = nil
+	return marshalCompound(w, fields, extra)
+}
+
+func (s *Section) UnmarshalNBT(tagType byte, r nbt.DecoderReader) (err error) {
+	s.Extra, err = unmarshalCompound(tagType, r, (*sectionFields_1_8_8)(s))
+	return
 }
 
 func (c *Chunk_1_8_8) IsEmpty() bool {
@@ -114,7 +140,7 @@ func (c *Chunk_1_8_8) IsEmpty() bool {
 	return false
 }
 
-func (c *Chunk_1_8_8) Optimize() bool {
+func (c *Chunk_1_8_8) Optimize() int {
 	before := len(c.Sections)
 	for i := len(c.Sections) - 1; i >= 0; i-- {
 		if !isZero(c.Sections[i].Blocks) {
@@ -125,46 +151,81 @@ func (c *Chunk_1_8_8) Optimize() bool {
 		}
 		c.Sections = append(c.Sections[:i], c.Sections[i+1:]...)
 	}
-	return before != len(c.Sections)
+	if before != len(c.Sections) {
+		c.sectionCache = nil
+	}
+	return before - len(c.Sections)
 }
 
+// ComputeHeightMap computes the height map like vanilla 1.8: the Y above the
+// highest block with a light opacity above 0, or 0 if there is none.
 func (c *Chunk_1_8_8) ComputeHeightMap() bool {
-	maxY := 0
-	for i := range c.Sections {
-		if c.Sections[i].Y > byte(maxY&15) {
-			maxY = int(c.Sections[i].Y)<<4 + 16
+	heights := c.heightMap()
+	if len(c.HeightMap) != 256 {
+		c.HeightMap = heights[:]
+		return true
+	}
+	changed := false
+	for idx, y := range heights {
+		if c.HeightMap[idx] != y {
+			c.HeightMap[idx] = y
+			changed = true
 		}
 	}
+	return changed
+}
 
-	changed := false
+// HeightMapMismatches returns the indexes z<<4|x of the columns where the
+// stored height map differs from the computed one.
+func (c *Chunk_1_8_8) HeightMapMismatches() []int {
+	var columns []int
+	for idx, y := range c.heightMap() {
+		if idx >= len(c.HeightMap) || c.HeightMap[idx] != y {
+			columns = append(columns, idx)
+		}
+	}
+	return columns
+}
+
+func (c *Chunk_1_8_8) heightMap() (heights [256]int32) {
 	for x := 0; x < 16; x++ {
 		for z := 0; z < 16; z++ {
-			for y := maxY; y > 0; y-- {
-				id, _ := c.GetType(x, y-1, z)
-				if !transparent_1_8_8[id] {
-					if c.HeightMap[z<<4|x] != int32(y) {
-						c.HeightMap[z<<4|x] = int32(y)
-						changed = true
-					}
-					break
-				}
-			}
+			y, _, _ := c.Surface(x, z)
+			heights[z<<4|x] = int32(y + 1)
 		}
 	}
-	return changed
+	return
 }
 
-func (c *Chunk_1_8_8) ComputeLowMap() []byte {
-	maxY := 0
-	minY := 255
+// Surface returns the height and the type of the highest block of the column
+// with a light opacity above 0, y is -1 if there is none.
+func (c *Chunk_1_8_8) Surface(x, z int) (y, id int, data byte) {
+	_, maxY := c.bounds()
+	for y := maxY - 1; y >= 0; y-- {
+		id, data := c.GetType(x, y, z)
+		if lightOpacity_1_8_8[id] != 0 {
+			return y, id, data
+		}
+	}
+	return -1, 0, 0
+}
+
+// bounds returns the Y range of the sections.
+func (c *Chunk_1_8_8) bounds() (minY, maxY int) {
 	for i := range c.Sections {
-		if c.Sections[i].Y > byte(maxY&15) {
-			maxY = int(c.Sections[i].Y)<<4 + 16
+		y := int(c.Sections[i].Y) << 4
+		if i == 0 || y < minY {
+			minY = y
 		}
-		if c.Sections[i].Y < byte(minY&15) {
-			minY = int(c.Sections[i].Y) << 4
+		if i == 0 || y+16 > maxY {
+			maxY = y + 16
 		}
 	}
+	return
+}
+
+func (c *Chunk_1_8_8) ComputeLowMap() []byte {
+	minY, maxY := c.bounds()
 
 	lowmap := make([]byte, 256+32)
 	for x := 0; x < 16; x++ {
@@ -215,7 +276,7 @@ func (c *Chunk_1_8_8) GetType(x, y, z int) (int, byte) {
 }
 
 func nibbleGet(data []byte, idx int) byte {
-	return data[idx>>1] >> ((idx & 1) << 2)
+	return data[idx>>1] >> ((idx & 1) << 2) & 0x0F
 }
 
 var dummyBytes [1 << 16]byte // 65536
@@ -223,7 +284,3 @@ var dummyBytes [1 << 16]byte // 65536
 func isZero(data []byte) bool {
 	return bytes.Equal(data, dummyBytes[:len(data)])
 }
-
-var gzipReaderPool sync.Pool
-var zlibReaderPool sync.Pool
-var zlibWriterPool sync.Pool
@@ -0,0 +1,441 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/bits"
+
+	"github.com/Tnze/go-mc/nbt"
+)
+
+// Data versions where the layout of paletted chunks changes
+const (
+	dataVersion_1_13 = 1451 // sections with a block palette
+	dataVersion_1_16 = 2527 // block states do not span multiple longs
+)
+
+// Chunk_1_13 is a chunk with paletted sections, used since 1.13.
+//
+// Before 1.18 the chunk is nested into the Level compound, since 1.18 its
+// tags are stored in the root compound under new names. Both layouts are
+// decoded into the same fields and written back in the original layout.
+type Chunk_1_13 struct {
+	DataVersion   int32
+	XPos          *int32          `nbt:"xPos"`
+	ZPos          *int32          `nbt:"zPos"`
+	InhabitedTime int64           `nbt:",omitempty"`
+	Sections      []Section_1_13  `nbt:"sections,omitempty"`
+	Entities      *nbt.RawMessage `nbt:"entities,omitempty"`
+	TileEntities  *nbt.RawMessage `nbt:"block_entities,omitempty"`
+	Structures    *nbt.RawMessage `nbt:"structures,omitempty"`
+
+	// Extra keeps the unknown tags of the chunk
+	Extra Extra `nbt:"-"`
+	// rootExtra keeps the unknown tags next to the Level compound,
+	// nil if the chunk has no Level compound
+	rootExtra Extra
+
+	sectionCache map[int8]*Section_1_13
+}
+
+type chunkFields_1_13 Chunk_1_13
+
+// levelFields_1_13 holds the tag names used inside the Level compound
+type levelFields_1_13 struct {
+	XPos          *int32          `nbt:"xPos"`
+	ZPos          *int32          `nbt:"zPos"`
+	InhabitedTime int64           `nbt:",omitempty"`
+	Entities      *nbt.RawMessage `nbt:",omitempty"`
+	TileEntities  *nbt.RawMessage `nbt:",omitempty"`
+	Structures    *nbt.RawMessage `nbt:",omitempty"`
+}
+
+type Section_1_13 struct {
+	Y int8
+	// Palette and BlockStates are used before 1.18
+	Palette     []BlockState `nbt:",omitempty"`
+	BlockStates []int64      `nbt:",omitempty"`
+	// Blocks and Biomes are used since 1.18
+	Blocks     *PalettedContainer `nbt:"block_states,omitempty"`
+	Biomes     *nbt.RawMessage    `nbt:"biomes,omitempty"`
+	BlockLight []byte             `nbt:",omitempty"`
+	SkyLight   []byte             `nbt:",omitempty"`
+
+	// Extra keeps the unknown tags of the section
+	Extra Extra `nbt:"-"`
+}
+
+type sectionFields_1_13 Section_1_13
+
+type PalettedContainer struct {
+	Palette []BlockState `nbt:"palette"`
+	Data    []int64      `nbt:"data,omitempty"`
+
+	// Extra keeps the unknown tags of the container
+	Extra Extra `nbt:"-"`
+}
+
+type palettedContainerFields PalettedContainer
+
+type BlockState struct {
+	Name       string
+	Properties map[string]string `nbt:",omitempty"`
+}
+
+func (c *Chunk_1_13) Load(data []byte) error {
+	raw, err := decompress(data)
+	if err != nil {
+		return err
+	}
+	return c.decode(raw)
+}
+
+func (c *Chunk_1_13) decode(raw []byte) error {
+	return nbt.Unmarshal(raw, c)
+}
+
+func (c *Chunk_1_13) Save() ([]byte, error) {
+	return encodeSector(c)
+}
+
+func (c *Chunk_1_13) Pos() (x, z int, ok bool) {
+	return chunkPos(c.XPos, c.ZPos)
+}
+
+func (c *Chunk_1_13) UnmarshalNBT(tagType byte, r nbt.DecoderReader) error {
+	extra, err := unmarshalCompound(tagType, r, (*chunkFields_1_13)(c))
+	if err != nil {
+		return err
+	}
+	level, ok := extra["Level"]
+	if !ok {
+		c.Extra = extra
+		return nil
+	}
+	delete(extra, "Level")
+	c.rootExtra = extra
+	// Field names match the tags of the Level compound too
+	c.Extra, err = unmarshalCompound(level.Type, bytes.NewReader(level.Data), (*chunkFields_1_13)(c))
+	return err
+}
+
+func (c *Chunk_1_13) TagType() byte {
+	return nbt.TagCompound
+}
+
+func (c *Chunk_1_13) MarshalNBT(w io.Writer) error {
+	sections, err := marshalSections(c.Sections)
+	if err != nil {
+		return err
+	}
+
+	if c.rootExtra == nil {
+		fields := chunkFields_1_13(*c)
+		fields.Sections = nil
+		extra := make(Extra, len(c.Extra)+1)
+		for name, tag := range c.Extra {
+			extra[name] = tag
+		}
+		extra["sections"] = sections
+		return marshalCompound(w, fields, extra)
+	}
+
+	levelExtra := make(Extra, len(c.Extra)+1)
+	for name, tag := range c.Extra {
+		levelExtra[name] = tag
+	}
+	levelExtra["Sections"] = sections
+	var level bytes.Buffer
+	err = marshalCompound(&level, levelFields_1_13{
+		XPos:          c.XPos,
+		ZPos:          c.ZPos,
+		InhabitedTime: c.InhabitedTime,
+		Entities:      c.Entities,
+		TileEntities:  c.TileEntities,
+		Structures:    c.Structures,
+	}, levelExtra)
+	if err != nil {
+		return err
+	}
+
+	rootExtra := make(Extra, len(c.rootExtra)+1)
+	for name, tag := range c.rootExtra {
+		rootExtra[name] = tag
+	}
+	rootExtra["Level"] = nbt.RawMessage{Type: nbt.TagCompound, Data: level.Bytes()}
+	return marshalCompound(w, struct{ DataVersion int32 }{c.DataVersion}, rootExtra)
+}
+
+func (s *Section_1_13) UnmarshalNBT(tagType byte, r nbt.DecoderReader) (err error) {
+	s.Extra, err = unmarshalCompound(tagType, r, (*sectionFields_1_13)(s))
+	return
+}
+
+func (p *PalettedContainer) UnmarshalNBT(tagType byte, r nbt.DecoderReader) (err error) {
+	p.Extra, err = unmarshalCompound(tagType, r, (*palettedContainerFields)(p))
+	return
+}
+
+func (p *PalettedContainer) TagType() byte {
+	return nbt.TagCompound
+}
+
+func (p *PalettedContainer) MarshalNBT(w io.Writer) error {
+	return marshalCompound(w, (*palettedContainerFields)(p), p.Extra)
+}
+
+// marshalSections encodes the list of sections. The nbt package does not
+// use custom marshalers for list elements, so it is written by hand.
+func marshalSections(sections []Section_1_13) (nbt.RawMessage, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(nbt.TagCompound)
+	_ = binary.Write(&buf, binary.BigEndian, int32(len(sections)))
+	for i := range sections {
+		if err := marshalCompound(&buf, sectionFields_1_13(sections[i]), sections[i].Extra); err != nil {
+			return nbt.RawMessage{}, err
+		}
+	}
+	return nbt.RawMessage{Type: nbt.TagList, Data: buf.Bytes()}, nil
+}
+
+func (c *Chunk_1_13) Inhabited() int64 {
+	return c.InhabitedTime
+}
+
+func (c *Chunk_1_13) HasTileEntities() bool {
+	return !isEmptyList(c.TileEntities)
+}
+
+func (c *Chunk_1_13) IsEmpty() bool {
+	for i := range c.Sections {
+		if !c.Sections[i].isAir(c.aligned()) {
+			return false
+		}
+	}
+	if !isEmptyList(c.Entities) || !isEmptyList(c.TileEntities) {
+		return false
+	}
+	return !c.hasStructureStarts()
+}
+
+// Optimize removes sections without blocks. Since 1.18 biomes are stored in
+// sections, so only sections the game restores identically are removed.
+func (c *Chunk_1_13) Optimize() int {
+	before := len(c.Sections)
+	for i := len(c.Sections) - 1; i >= 0; i-- {
+		s := &c.Sections[i]
+		if !s.isAir(c.aligned()) {
+			continue
+		}
+		if s.Biomes != nil && !isDefaultBiome(*s.Biomes) {
+			continue
+		}
+		c.Sections = append(c.Sections[:i], c.Sections[i+1:]...)
+	}
+	if before != len(c.Sections) {
+		c.sectionCache = nil
+	}
+	return before - len(c.Sections)
+}
+
+// ComputeHeightMap does nothing for paletted chunks, the game keeps their
+// height maps up to date by itself.
+func (c *Chunk_1_13) ComputeHeightMap() bool {
+	return false
+}
+
+// ComputeLowMap works like Chunk_1_8_8.ComputeLowMap. Blocks below zero
+// are reported at zero to fit the format.
+func (c *Chunk_1_13) ComputeLowMap() []byte {
+	minY, maxY := 0, 0
+	for i := range c.Sections {
+		y := int(c.Sections[i].Y) << 4
+		if i == 0 || y < minY {
+			minY = y
+		}
+		if i == 0 || y+16 > maxY {
+			maxY = y + 16
+		}
+	}
+
+	lowmap := make([]byte, 256+32)
+	for x := 0; x < 16; x++ {
+		for z := 0; z < 16; z++ {
+			blockFound := false
+			for y := minY; y < maxY; y++ {
+				if !isAirBlock(c.GetBlock(x, y, z)) {
+					blockFound = true
+					if y < 0 {
+						y = 0
+					} else if y > 254 {
+						y = 254
+					}
+					lowmap[z<<4|x] = byte(y)
+					break
+				}
+			}
+			if !blockFound {
+				idx := z<<4 | x
+				lowmap[idx] = 255
+
+				// bloom filter
+				lowmap[256+idx/8] |= 0x80 >> uint(idx%8)
+			}
+		}
+	}
+	return lowmap
+}
+
+// GetBlock returns the block name at the chunk relative position.
+func (c *Chunk_1_13) GetBlock(x, y, z int) string {
+	if c.sectionCache == nil {
+		c.sectionCache = make(map[int8]*Section_1_13, len(c.Sections))
+		for i := range c.Sections {
+			c.sectionCache[c.Sections[i].Y] = &c.Sections[i]
+		}
+	}
+	sec := c.sectionCache[int8(y>>4)]
+	if sec == nil || y>>4 != int(int8(y>>4)) {
+		return "minecraft:air"
+	}
+	palette, data := sec.blocks()
+	if len(palette) == 0 {
+		return "minecraft:air"
+	}
+	if len(palette) == 1 {
+		return palette[0].Name
+	}
+	idx := sec.paletteIndex((y&15)<<8|(z&15)<<4|(x&15), c.aligned())
+	if idx >= len(palette) || len(data) == 0 {
+		return "minecraft:air"
+	}
+	return palette[idx].Name
+}
+
+func (c *Chunk_1_13) aligned() bool {
+	return c.DataVersion >= dataVersion_1_16
+}
+
+func (c *Chunk_1_13) hasStructureStarts() bool {
+	if c.Structures == nil {
+		return false
+	}
+	var structures struct {
+		Starts map[string]struct {
+			ID string `nbt:"id"`
+		} `nbt:"starts"`
+	}
+	if err := c.Structures.Unmarshal(&structures); err != nil {
+		return true
+	}
+	for _, start := range structures.Starts {
+		if start.ID != "INVALID" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Section_1_13) blocks() ([]BlockState, []int64) {
+	if s.Blocks != nil {
+		return s.Blocks.Palette, s.Blocks.Data
+	}
+	return s.Palette, s.BlockStates
+}
+
+// bitsPerBlock returns the size of a palette index in the packed data
+func (s *Section_1_13) bitsPerBlock() int {
+	palette, _ := s.blocks()
+	n := bits.Len(uint(len(palette) - 1))
+	if n < 4 {
+		n = 4
+	}
+	return n
+}
+
+// paletteIndex unpacks the palette index of the block with the section index
+// idx. The aligned layout does not let indices span two longs.
+func (s *Section_1_13) paletteIndex(idx int, aligned bool) int {
+	_, data := s.blocks()
+	size := s.bitsPerBlock()
+	mask := uint64(1)<<size - 1
+	if aligned {
+		perLong := 64 / size
+		i := idx / perLong
+		if i >= len(data) {
+			return -1
+		}
+		return int(uint64(data[i]) >> (idx % perLong * size) & mask)
+	}
+	bit := idx * size
+	i, offset := bit/64, bit%64
+	if i >= len(data) {
+		return -1
+	}
+	value := uint64(data[i]) >> offset
+	if offset+size > 64 {
+		if i+1 >= len(data) {
+			return -1
+		}
+		value |= uint64(data[i+1]) << (64 - offset)
+	}
+	return int(value & mask)
+}
+
+// isAir reports whether all blocks of the section are air. Sections with
+// malformed block data are never considered air.
+func (s *Section_1_13) isAir(aligned bool) bool {
+	palette, data := s.blocks()
+	used := make([]bool, len(palette))
+	anySolid := false
+	for i := range palette {
+		if !isAirBlock(palette[i].Name) {
+			anySolid = true
+		}
+	}
+	if !anySolid {
+		return true
+	}
+	if len(palette) == 1 || len(data) == 0 {
+		return false
+	}
+	for i := 0; i < 4096; i++ {
+		idx := s.paletteIndex(i, aligned)
+		if idx < 0 || idx >= len(palette) {
+			return false
+		}
+		if !used[idx] {
+			if !isAirBlock(palette[idx].Name) {
+				return false
+			}
+			used[idx] = true
+		}
+	}
+	return true
+}
+
+func isAirBlock(name string) bool {
+	switch name {
+	case "minecraft:air", "minecraft:cave_air", "minecraft:void_air":
+		return true
+	}
+	return false
+}
+
+// isDefaultBiome reports whether a biome container of a section holds only
+// the biome the game fills missing sections with.
+func isDefaultBiome(biomes nbt.RawMessage) bool {
+	var container struct {
+		Palette []string `nbt:"palette"`
+	}
+	if err := biomes.Unmarshal(&container); err != nil {
+		return false
+	}
+	return len(container.Palette) == 1 && container.Palette[0] == "minecraft:plains"
+}
+
+// isEmptyList reports whether the tag is missing or an empty list
+func isEmptyList(tag *nbt.RawMessage) bool {
+	return tag == nil || tag.Type == nbt.TagList && len(tag.Data) == 5 && tag.Data[1]|tag.Data[2]|tag.Data[3]|tag.Data[4] == 0
+}
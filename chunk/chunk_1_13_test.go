@@ -0,0 +1,254 @@
+package chunk
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Tnze/go-mc/nbt"
+)
+
+// testPalette returns a palette of air and n-1 other blocks, needing five
+// bits per block for n = 17.
+func testPalette(n int) []map[string]interface{} {
+	palette := []map[string]interface{}{{"Name": "minecraft:air"}}
+	for i := 1; i < n; i++ {
+		palette = append(palette, map[string]interface{}{"Name": fmt.Sprint("minecraft:block_", i)})
+	}
+	return palette
+}
+
+// packBlocks packs the palette indices of the 4096 blocks of a section with
+// the bits per block of the palette size. The aligned layout of 1.16 does
+// not let indices span two longs.
+func packBlocks(indices func(idx int) int, paletteSize int, aligned bool) []int64 {
+	size := 4
+	for 1<<size < paletteSize {
+		size++
+	}
+	var data []uint64
+	if aligned {
+		perLong := 64 / size
+		data = make([]uint64, (4096+perLong-1)/perLong)
+		for idx := 0; idx < 4096; idx++ {
+			data[idx/perLong] |= uint64(indices(idx)) << (idx % perLong * size)
+		}
+	} else {
+		data = make([]uint64, 4096*size/64)
+		for idx := 0; idx < 4096; idx++ {
+			bit := idx * size
+			data[bit/64] |= uint64(indices(idx)) << (bit % 64)
+			if bit%64+size > 64 {
+				data[bit/64+1] |= uint64(indices(idx)) >> (64 - bit%64)
+			}
+		}
+	}
+	longs := make([]int64, len(data))
+	for i, v := range data {
+		longs[i] = int64(v)
+	}
+	return longs
+}
+
+// roundTrip decodes the chunk and checks that saving it gives the same NBT.
+func roundTrip(t *testing.T, tags map[string]interface{}) *Chunk_1_13 {
+	t.Helper()
+	raw, err := nbt.Marshal(tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := new(Chunk_1_13)
+	if err := c.decode(raw); err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := decompress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := decodeTree(t, raw), decodeTree(t, saved); !reflect.DeepEqual(want, got) {
+		t.Errorf("NBT changed by load and save:\nwant %v\n got %v", want, got)
+	}
+	return c
+}
+
+// checkBlocks checks the blocks of the section at the height y.
+func checkBlocks(t *testing.T, c *Chunk_1_13, y int, indices func(idx int) int) {
+	t.Helper()
+	for idx := 0; idx < 4096; idx++ {
+		want := "minecraft:air"
+		if i := indices(idx); i > 0 {
+			want = fmt.Sprint("minecraft:block_", i)
+		}
+		x, by, z := idx&15, y<<4|idx>>8, idx>>4&15
+		if got := c.GetBlock(x, by, z); got != want {
+			t.Fatalf("block at %d %d %d is %s, want %s", x, by, z, got, want)
+		}
+	}
+}
+
+// level_1_13 returns the tags of a chunk nested into the Level compound.
+func level_1_13(dataVersion int32, sections ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"DataVersion": dataVersion,
+		"ForgeCaps":   map[string]interface{}{"mod": int32(7)},
+		"Level": map[string]interface{}{
+			"xPos":          int32(-5),
+			"zPos":          int32(9),
+			"InhabitedTime": int64(300),
+			"Status":        "full",
+			"Entities":      []map[string]interface{}{},
+			"TileEntities":  []map[string]interface{}{},
+			"Sections":      sections,
+		},
+	}
+}
+
+func TestChunk_1_13_Packed(t *testing.T) {
+	// Five bits per block, so every 64 bits an index spans two longs
+	indices := func(idx int) int { return idx * 7 % 17 }
+	c := roundTrip(t, level_1_13(2230,
+		map[string]interface{}{"Y": int8(-1), "SkyLight": make([]byte, 2048)},
+		map[string]interface{}{
+			"Y":           int8(2),
+			"Palette":     testPalette(17),
+			"BlockStates": packBlocks(indices, 17, false),
+			"BlockLight":  make([]byte, 2048),
+			"Custom":      "section tag",
+		},
+	))
+	checkBlocks(t, c, 2, indices)
+	checkBlocks(t, c, 3, func(int) int { return 0 })
+	if x, z, ok := c.Pos(); x != -5 || z != 9 || !ok {
+		t.Errorf("position %d %d %v, want -5 9", x, z, ok)
+	}
+	if c.Inhabited() != 300 {
+		t.Errorf("inhabited time %d, want 300", c.Inhabited())
+	}
+	if c.IsEmpty() {
+		t.Error("chunk with blocks is empty")
+	}
+}
+
+func TestChunk_1_13_Aligned(t *testing.T) {
+	indices := func(idx int) int { return idx * 7 % 17 }
+	c := roundTrip(t, level_1_13(2586, map[string]interface{}{
+		"Y":           int8(0),
+		"Palette":     testPalette(17),
+		"BlockStates": packBlocks(indices, 17, true),
+	}))
+	if n := len(c.Sections[0].BlockStates); n != 342 {
+		t.Errorf("%d longs of aligned block states, want 342", n)
+	}
+	checkBlocks(t, c, 0, indices)
+}
+
+func TestChunk_1_18_RootLayout(t *testing.T) {
+	indices := func(idx int) int { return idx % 3 }
+	c := roundTrip(t, map[string]interface{}{
+		"DataVersion":    int32(2975),
+		"xPos":           int32(4),
+		"yPos":           int32(-4),
+		"zPos":           int32(-8),
+		"Status":         "minecraft:full",
+		"InhabitedTime":  int64(20),
+		"block_entities": []map[string]interface{}{},
+		"structures":     map[string]interface{}{"starts": map[string]interface{}{}},
+		"sections": []map[string]interface{}{
+			{
+				"Y": int8(-4),
+				"block_states": map[string]interface{}{
+					"palette": testPalette(3),
+					"data":    packBlocks(indices, 3, true),
+				},
+				"biomes":   map[string]interface{}{"palette": []string{"minecraft:plains"}},
+				"SkyLight": make([]byte, 2048),
+			},
+			{
+				"Y": int8(0),
+				"block_states": map[string]interface{}{
+					"palette": []map[string]interface{}{{"Name": "minecraft:block_1"}},
+				},
+				"biomes": map[string]interface{}{"palette": []string{"minecraft:plains"}},
+			},
+		},
+	})
+	if c.rootExtra != nil {
+		t.Error("root layout decoded as a Level compound")
+	}
+	checkBlocks(t, c, -4, indices)
+	checkBlocks(t, c, 0, func(int) int { return 1 })
+	checkBlocks(t, c, 1, func(int) int { return 0 })
+	if x, z, ok := c.Pos(); x != 4 || z != -8 || !ok {
+		t.Errorf("position %d %d %v, want 4 -8", x, z, ok)
+	}
+	if c.HasTileEntities() {
+		t.Error("empty block entities found")
+	}
+}
+
+func TestChunk_1_13_Optimize(t *testing.T) {
+	biomes := func(biome string) map[string]interface{} {
+		return map[string]interface{}{"palette": []string{biome}}
+	}
+	blocks := func(palette []map[string]interface{}, indices func(idx int) int) map[string]interface{} {
+		return map[string]interface{}{
+			"palette": palette,
+			"data":    packBlocks(indices, len(palette), true),
+		}
+	}
+	air := []map[string]interface{}{{"Name": "minecraft:air"}}
+	air0 := func(int) int { return 0 }
+	oneBlock := func(idx int) int {
+		if idx == 4095 {
+			return 1
+		}
+		return 0
+	}
+	c := roundTrip(t, map[string]interface{}{
+		"DataVersion": int32(2975),
+		"xPos":        int32(0),
+		"zPos":        int32(0),
+		"sections": []map[string]interface{}{
+			// Air of the plains, as the game restores it
+			{"Y": int8(-4), "block_states": map[string]interface{}{"palette": air}, "biomes": biomes("minecraft:plains")},
+			// A desert is kept
+			{"Y": int8(-3), "block_states": map[string]interface{}{"palette": air}, "biomes": biomes("minecraft:desert")},
+			// Only air of a palette with another block
+			{"Y": int8(-2), "block_states": blocks(testPalette(2), air0), "biomes": biomes("minecraft:plains")},
+			// A single block
+			{"Y": int8(-1), "block_states": blocks(testPalette(2), oneBlock), "biomes": biomes("minecraft:plains")},
+			// Cave air without biomes
+			{"Y": int8(0), "block_states": map[string]interface{}{"palette": []map[string]interface{}{{"Name": "minecraft:cave_air"}}}},
+		},
+	})
+	if n := c.Optimize(); n != 3 {
+		t.Errorf("%d sections removed, want 3", n)
+	}
+	var kept []int8
+	for _, s := range c.Sections {
+		kept = append(kept, s.Y)
+	}
+	if want := []int8{-3, -1}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("sections %v kept, want %v", kept, want)
+	}
+	if got := c.GetBlock(15, -1, 15); got != "minecraft:block_1" {
+		t.Errorf("block at 15 -1 15 is %s after optimizing", got)
+	}
+
+	// Before 1.18 sections have no biomes
+	packed := roundTrip(t, level_1_13(2230,
+		map[string]interface{}{"Y": int8(0), "Palette": testPalette(2), "BlockStates": packBlocks(air0, 2, false)},
+		map[string]interface{}{"Y": int8(1), "Palette": testPalette(2), "BlockStates": packBlocks(oneBlock, 2, false)},
+		map[string]interface{}{"Y": int8(2), "SkyLight": make([]byte, 2048)},
+	))
+	if n := packed.Optimize(); n != 2 || len(packed.Sections) != 1 || packed.Sections[0].Y != 1 {
+		t.Errorf("%d sections removed, %d kept, want only the section with a block", n, len(packed.Sections))
+	}
+	if packed.IsEmpty() {
+		t.Error("chunk with a block is empty")
+	}
+}
@@ -0,0 +1,165 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Tnze/go-mc/nbt"
+)
+
+// section_1_8_8 returns the tags of a 1.8 section with the blocks set by fn.
+func section_1_8_8(y byte, fn func(x, y, z int) byte) map[string]interface{} {
+	blocks := make([]byte, 4096)
+	if fn != nil {
+		for i := range blocks {
+			blocks[i] = fn(i&15, i>>8, i>>4&15)
+		}
+	}
+	return map[string]interface{}{
+		"Y":          y,
+		"Blocks":     blocks,
+		"Data":       make([]byte, 2048),
+		"SkyLight":   make([]byte, 2048),
+		"BlockLight": make([]byte, 2048),
+	}
+}
+
+// chunk_1_8_8 returns the tags of a 1.8 chunk with the sections.
+func chunk_1_8_8(sections ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"Level": map[string]interface{}{
+			"xPos":             int32(3),
+			"zPos":             int32(-2),
+			"InhabitedTime":    int64(1200),
+			"LastUpdate":       int64(42),
+			"LightPopulated":   byte(1),
+			"TerrainPopulated": byte(1),
+			"Biomes":           make([]byte, 256),
+			"HeightMap":        make([]int32, 256),
+			"Entities":         []map[string]interface{}{{"id": "Pig"}},
+			"TileEntities":     []map[string]interface{}{},
+			"Sections":         sections,
+		},
+	}
+}
+
+// decodeTree decodes NBT data into generic values for comparison.
+func decodeTree(t *testing.T, raw []byte) interface{} {
+	t.Helper()
+	var tree interface{}
+	if err := nbt.Unmarshal(raw, &tree); err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestChunk_1_8_8_RoundTrip(t *testing.T) {
+	section := section_1_8_8(0, func(x, y, z int) byte { return 1 })
+	section["Custom"] = "section tag"
+	tags := chunk_1_8_8(section, section_1_8_8(1, nil))
+	tags["ForgeCaps"] = map[string]interface{}{"mod": int32(7)}
+	tags["Level"].(map[string]interface{})["TileTicks"] = []map[string]interface{}{{"i": "minecraft:water", "t": int32(3)}}
+
+	raw, err := nbt.Marshal(tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := new(Chunk_1_8_8)
+	if err := c.decode(raw); err != nil {
+		t.Fatal(err)
+	}
+	if c.Sections[0].Extra["Custom"].Type != nbt.TagString {
+		t.Fatalf("section tag Custom not kept: %v", c.Sections[0].Extra)
+	}
+
+	data, err := c.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := decompress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := decodeTree(t, raw), decodeTree(t, saved); !reflect.DeepEqual(want, got) {
+		t.Errorf("NBT changed by load and save:\nwant %v\n got %v", want, got)
+	}
+}
+
+func TestChunk_1_8_8_HeightMap(t *testing.T) {
+	const (
+		stone  = 1
+		water  = 9
+		leaves = 18
+		glass  = 20
+	)
+	// Columns of the row z=0 from x=0, the others are stone up to y=63
+	columns := []struct {
+		block  byte
+		top    int
+		height int32
+	}{
+		{glass, 69, 64},
+		{leaves, 66, 67},
+		{water, 70, 71},
+		{0, -1, 0},
+		{stone, 255, 256},
+	}
+	block := func(x, y, z int) byte {
+		if z == 0 && x < len(columns) {
+			col := columns[x]
+			switch {
+			case col.top < 0 || y > col.top:
+				return 0
+			case y >= 64:
+				return col.block
+			}
+		} else if y >= 64 {
+			return 0
+		}
+		return stone
+	}
+
+	var sections []map[string]interface{}
+	for sy := 0; sy < 16; sy++ {
+		sy := sy
+		sections = append(sections, section_1_8_8(byte(sy), func(x, y, z int) byte {
+			return block(x, sy<<4|y, z)
+		}))
+	}
+	tags := chunk_1_8_8(sections...)
+	stored := make([]int32, 256)
+	for i := range stored {
+		stored[i] = 64
+	}
+	tags["Level"].(map[string]interface{})["HeightMap"] = stored
+	raw, err := nbt.Marshal(tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := new(Chunk_1_8_8)
+	if err := c.decode(raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := c.HeightMapMismatches(), []int{1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mismatches %v, want %v", got, want)
+	}
+	if !c.ComputeHeightMap() {
+		t.Error("height map not changed")
+	}
+	for idx, y := range c.HeightMap {
+		want := int32(64)
+		if x := idx & 15; idx>>4 == 0 && x < len(columns) {
+			want = columns[x].height
+		}
+		if y != want {
+			t.Errorf("height of column %d,%d is %d, want %d", idx&15, idx>>4, y, want)
+		}
+	}
+	if n := len(c.HeightMapMismatches()); n != 0 {
+		t.Errorf("%d mismatches after computing the height map", n)
+	}
+	if c.ComputeHeightMap() {
+		t.Error("height map changed twice")
+	}
+}
@@ -76,3 +76,161 @@ var transparent_1_8_8 = map[int]bool{
 	834: true,
 	835: true,
 }
+
+// translucent_1_8_8 lists the blocks letting the light through with their
+// light opacity. Other blocks are opaque.
+var translucent_1_8_8 = map[int]uint8{
+	0:   0,
+	6:   0,
+	8:   3,
+	9:   3,
+	10:  0,
+	11:  0,
+	18:  1,
+	20:  0,
+	26:  0,
+	27:  0,
+	28:  0,
+	29:  0,
+	30:  1,
+	31:  0,
+	32:  0,
+	33:  0,
+	34:  0,
+	36:  0,
+	37:  0,
+	38:  0,
+	39:  0,
+	40:  0,
+	50:  0,
+	51:  0,
+	52:  0,
+	54:  0,
+	55:  0,
+	59:  0,
+	63:  0,
+	64:  0,
+	65:  0,
+	66:  0,
+	68:  0,
+	69:  0,
+	70:  0,
+	71:  0,
+	72:  0,
+	75:  0,
+	76:  0,
+	77:  0,
+	78:  0,
+	79:  3,
+	81:  0,
+	83:  0,
+	85:  0,
+	90:  0,
+	92:  0,
+	93:  0,
+	94:  0,
+	95:  0,
+	96:  0,
+	101: 0,
+	102: 0,
+	104: 0,
+	105: 0,
+	106: 0,
+	107: 0,
+	111: 0,
+	113: 0,
+	115: 0,
+	116: 0,
+	117: 0,
+	118: 0,
+	119: 0,
+	120: 0,
+	122: 0,
+	127: 0,
+	130: 0,
+	131: 0,
+	132: 0,
+	138: 0,
+	139: 0,
+	140: 0,
+	141: 0,
+	142: 0,
+	143: 0,
+	144: 0,
+	145: 0,
+	146: 0,
+	147: 0,
+	148: 0,
+	149: 0,
+	150: 0,
+	151: 0,
+	154: 0,
+	157: 0,
+	160: 0,
+	161: 1,
+	165: 0,
+	166: 0,
+	167: 0,
+	171: 0,
+	175: 0,
+	176: 0,
+	177: 0,
+	178: 0,
+	183: 0,
+	184: 0,
+	185: 0,
+	186: 0,
+	187: 0,
+	188: 0,
+	189: 0,
+	190: 0,
+	191: 0,
+	192: 0,
+	193: 0,
+	194: 0,
+	195: 0,
+	196: 0,
+	197: 0,
+}
+
+// emission_1_8_8 lists the blocks emitting light with their light level.
+var emission_1_8_8 = map[int]uint8{
+	10:  15,
+	11:  15,
+	39:  1,
+	50:  14,
+	51:  15,
+	62:  13,
+	74:  9,
+	76:  7,
+	89:  15,
+	90:  11,
+	91:  15,
+	94:  9,
+	117: 1,
+	119: 15,
+	120: 1,
+	122: 1,
+	124: 15,
+	130: 7,
+	138: 15,
+	150: 9,
+	169: 15,
+}
+
+// lightOpacity_1_8_8 and lightEmission_1_8_8 are lookup tables by block ID.
+var lightOpacity_1_8_8, lightEmission_1_8_8 = func() (opacity, emission [4096]uint8) {
+	for id := range opacity {
+		if value, ok := translucent_1_8_8[id]; ok {
+			opacity[id] = value
+		} else if id > 197 && transparent_1_8_8[id] {
+			opacity[id] = 0
+		} else {
+			opacity[id] = 255
+		}
+	}
+	for id, value := range emission_1_8_8 {
+		emission[id] = value
+	}
+	return
+}()
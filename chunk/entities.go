@@ -0,0 +1,130 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/Tnze/go-mc/nbt"
+)
+
+// EntityRules select the entities removed from 1.8 chunks. Kept entities
+// are never removed, neither by Remove nor by MaxPerType.
+type EntityRules struct {
+	// Remove lists the IDs of removed entities, like Item or Arrow
+	Remove []string `json:"remove"`
+	// RemoveHostile removes hostile mobs
+	RemoveHostile bool `json:"remove_hostile"`
+	// MaxPerType limits the number of entities of a type per chunk
+	MaxPerType int `json:"max_per_type"`
+	// Keep lists the IDs of kept entities, like ItemFrame or ArmorStand
+	Keep []string `json:"keep"`
+	// KeepNamed keeps entities with a custom name
+	KeepNamed bool `json:"keep_named"`
+	// KeepLeashed keeps leashed mobs
+	KeepLeashed bool `json:"keep_leashed"`
+}
+
+// DefaultEntityRules removes dropped items, experience orbs, projectiles and
+// falling blocks.
+var DefaultEntityRules = EntityRules{
+	Remove: []string{
+		"Item", "XPOrb", "Arrow", "Snowball", "Fireball", "SmallFireball",
+		"ThrownEnderpearl", "ThrownExpBottle", "ThrownPotion", "WitherSkull",
+		"FallingSand", "PrimedTnt", "FireworksRocketEntity",
+	},
+	Keep:        []string{"ItemFrame", "Painting", "ArmorStand", "LeashKnot"},
+	KeepNamed:   true,
+	KeepLeashed: true,
+}
+
+var hostile_1_8_8 = map[string]bool{
+	"Creeper":     true,
+	"Skeleton":    true,
+	"Spider":      true,
+	"Giant":       true,
+	"Zombie":      true,
+	"Slime":       true,
+	"Ghast":       true,
+	"PigZombie":   true,
+	"Enderman":    true,
+	"CaveSpider":  true,
+	"Silverfish":  true,
+	"Blaze":       true,
+	"LavaSlime":   true,
+	"EnderDragon": true,
+	"WitherBoss":  true,
+	"Witch":       true,
+	"Endermite":   true,
+	"Guardian":    true,
+}
+
+type entity_1_8_8 struct {
+	Id         string `nbt:"id"`
+	CustomName string
+	Leashed    byte
+}
+
+// FilterEntities removes the entities selected by the rules and returns the
+// number of removed entities by ID.
+func (c *Chunk_1_8_8) FilterEntities(rules *EntityRules) (map[string]int, error) {
+	if len(c.Entities.Data) <= 5 {
+		return nil, nil
+	}
+	var entities []nbt.RawMessage
+	if err := c.Entities.Unmarshal(&entities); err != nil {
+		return nil, err
+	}
+
+	remove := make(map[string]bool, len(rules.Remove))
+	for _, id := range rules.Remove {
+		remove[id] = true
+	}
+	keep := make(map[string]bool, len(rules.Keep))
+	for _, id := range rules.Keep {
+		keep[id] = true
+	}
+
+	var removed map[string]int
+	kept := entities[:0]
+	perType := make(map[string]int)
+	for _, raw := range entities {
+		var e entity_1_8_8
+		if err := raw.Unmarshal(&e); err != nil {
+			return nil, err
+		}
+		switch {
+		case keep[e.Id] || rules.KeepNamed && e.CustomName != "" || rules.KeepLeashed && e.Leashed != 0:
+		case remove[e.Id] || rules.RemoveHostile && hostile_1_8_8[e.Id],
+			rules.MaxPerType > 0 && perType[e.Id] >= rules.MaxPerType:
+			if removed == nil {
+				removed = make(map[string]int)
+			}
+			removed[e.Id]++
+			continue
+		default:
+			perType[e.Id]++
+		}
+		kept = append(kept, raw)
+	}
+
+	if removed != nil {
+		c.Entities = compoundList(kept)
+	}
+	return removed, nil
+}
+
+// compoundList encodes a list of compounds. An empty list has no element
+// type like the game writes it.
+func compoundList(elements []nbt.RawMessage) nbt.RawMessage {
+	var buf bytes.Buffer
+	if len(elements) == 0 {
+		buf.WriteByte(nbt.TagEnd)
+	} else {
+		buf.WriteByte(nbt.TagCompound)
+	}
+	_ = binary.Write(&buf, binary.BigEndian, int32(len(elements)))
+	for _, e := range elements {
+		buf.Write(e.Data)
+	}
+	return nbt.RawMessage{Type: nbt.TagList, Data: buf.Bytes()}
+}
@@ -0,0 +1,156 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Tnze/go-mc/nbt"
+)
+
+// entityChunk returns a decoded 1.8 chunk with the entities, numbered by
+// their index in the tag N.
+func entityChunk(t *testing.T, entities ...map[string]interface{}) *Chunk_1_8_8 {
+	t.Helper()
+	for i, e := range entities {
+		e["N"] = int32(i)
+	}
+	tags := chunk_1_8_8()
+	tags["Level"].(map[string]interface{})["Entities"] = entities
+	raw, err := nbt.Marshal(tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := new(Chunk_1_8_8)
+	if err := c.decode(raw); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// entity returns the tags of an entity with the ID and optional name.
+func entity(id, name string) map[string]interface{} {
+	e := map[string]interface{}{"id": id, "Pos": []float64{1, 2, 3}}
+	if name != "" {
+		e["CustomName"] = name
+	}
+	return e
+}
+
+func leashed(id string) map[string]interface{} {
+	e := entity(id, "")
+	e["Leashed"] = byte(1)
+	return e
+}
+
+func TestFilterEntities(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rules    EntityRules
+		entities []map[string]interface{}
+		removed  map[string]int
+		kept     []int32
+	}{
+		{
+			name:  "default rules",
+			rules: DefaultEntityRules,
+			entities: []map[string]interface{}{
+				entity("Item", ""), entity("Item", "Loot"), entity("Arrow", ""), entity("Pig", ""),
+				entity("Zombie", ""), entity("ItemFrame", ""), entity("XPOrb", ""), leashed("Arrow"),
+			},
+			removed: map[string]int{"Item": 1, "Arrow": 1, "XPOrb": 1},
+			kept:    []int32{1, 3, 4, 5, 7},
+		},
+		{
+			name:     "keep before remove",
+			rules:    EntityRules{Remove: []string{"Item", "ArmorStand"}, Keep: []string{"ArmorStand"}},
+			entities: []map[string]interface{}{entity("ArmorStand", ""), entity("Item", "")},
+			removed:  map[string]int{"Item": 1},
+			kept:     []int32{0},
+		},
+		{
+			name:  "keep named",
+			rules: EntityRules{Remove: []string{"Item"}, KeepNamed: true},
+			entities: []map[string]interface{}{
+				entity("Item", "Loot"), entity("Item", ""), leashed("Item"),
+			},
+			removed: map[string]int{"Item": 2},
+			kept:    []int32{0},
+		},
+		{
+			name:  "keep leashed",
+			rules: EntityRules{RemoveHostile: true, KeepLeashed: true},
+			entities: []map[string]interface{}{
+				leashed("Zombie"), entity("Zombie", "Bob"), entity("Cow", ""),
+			},
+			removed: map[string]int{"Zombie": 1},
+			kept:    []int32{0, 2},
+		},
+		{
+			name:  "remove hostile",
+			rules: EntityRules{RemoveHostile: true},
+			entities: []map[string]interface{}{
+				entity("Creeper", ""), entity("Pig", ""), entity("Zombie", ""), entity("Wolf", ""), entity("Ghast", ""),
+			},
+			removed: map[string]int{"Creeper": 1, "Zombie": 1, "Ghast": 1},
+			kept:    []int32{1, 3},
+		},
+		{
+			// Kept entities do not count against the limit
+			name:  "max per type",
+			rules: EntityRules{MaxPerType: 2, Keep: []string{"ArmorStand"}, KeepNamed: true},
+			entities: []map[string]interface{}{
+				entity("Pig", "Named"), entity("Pig", ""), entity("Cow", ""), entity("Pig", ""), entity("Pig", ""),
+				entity("ArmorStand", ""), entity("ArmorStand", ""), entity("ArmorStand", ""), entity("Pig", "Late"),
+			},
+			removed: map[string]int{"Pig": 1},
+			kept:    []int32{0, 1, 2, 3, 5, 6, 7, 8},
+		},
+		{
+			name:     "nothing removed",
+			rules:    DefaultEntityRules,
+			entities: []map[string]interface{}{entity("Pig", ""), entity("Painting", "")},
+			kept:     []int32{0, 1},
+		},
+		{
+			name:     "all removed",
+			rules:    DefaultEntityRules,
+			entities: []map[string]interface{}{entity("Item", ""), entity("Snowball", "")},
+			removed:  map[string]int{"Item": 1, "Snowball": 1},
+		},
+	} {
+		c := entityChunk(t, tc.entities...)
+		removed, err := c.FilterEntities(&tc.rules)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(removed, tc.removed) {
+			t.Errorf("%s: removed %v, want %v", tc.name, removed, tc.removed)
+		}
+		var kept []struct{ N int32 }
+		if err := c.Entities.Unmarshal(&kept); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var got []int32
+		for _, e := range kept {
+			got = append(got, e.N)
+		}
+		if !reflect.DeepEqual(got, tc.kept) {
+			t.Errorf("%s: kept %v, want %v", tc.name, got, tc.kept)
+		}
+	}
+}
+
+func TestFilterEntities_Empty(t *testing.T) {
+	c := entityChunk(t, entity("Item", ""))
+	if _, err := c.FilterEntities(&DefaultEntityRules); err != nil {
+		t.Fatal(err)
+	}
+	// The game writes an empty list without an element type
+	if want := []byte{nbt.TagEnd, 0, 0, 0, 0}; c.Entities.Type != nbt.TagList || !reflect.DeepEqual(c.Entities.Data, want) {
+		t.Errorf("entities %d %v, want an empty list", c.Entities.Type, c.Entities.Data)
+	}
+	removed, err := c.FilterEntities(&DefaultEntityRules)
+	if removed != nil || err != nil {
+		t.Errorf("entities removed from an empty list: %v, %v", removed, err)
+	}
+}
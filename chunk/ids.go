@@ -0,0 +1,47 @@
+package chunk
+
+import (
+	"github.com/Tnze/go-mc/nbt"
+)
+
+// EntityIDs returns the IDs of the entities and the tile entities.
+func (c *Chunk_1_8_8) EntityIDs() (entities, tileEntities []string, err error) {
+	if entities, err = listIDs(&c.Entities); err != nil {
+		return nil, nil, err
+	}
+	tileEntities, err = listIDs(&c.TileEntities)
+	return
+}
+
+// EntityIDs returns the IDs of the entities and the tile entities stored in
+// the chunk. Since 1.17 entities are stored in the entities folder.
+func (c *Chunk_1_13) EntityIDs() (entities, tileEntities []string, err error) {
+	if entities, err = listIDs(c.Entities); err != nil {
+		return nil, nil, err
+	}
+	tileEntities, err = listIDs(c.TileEntities)
+	return
+}
+
+// EntityIDs returns the IDs of the entities.
+func (c *EntityChunk) EntityIDs() ([]string, error) {
+	return listIDs(c.Entities)
+}
+
+// listIDs returns the id tags of a list of compounds.
+func listIDs(list *nbt.RawMessage) ([]string, error) {
+	if list == nil || len(list.Data) <= 5 {
+		return nil, nil
+	}
+	var elements []struct {
+		Id string `nbt:"id"`
+	}
+	if err := list.Unmarshal(&elements); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(elements))
+	for i, e := range elements {
+		ids[i] = e.Id
+	}
+	return ids, nil
+}
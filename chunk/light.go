@@ -0,0 +1,271 @@
+package chunk
+
+import (
+	"bytes"
+)
+
+// Light is computed in a window of 3x3 chunks around the relit chunk. Light
+// travels at most 15 blocks, so nothing outside the window reaches the
+// chunk in the middle.
+const lightWindow = 48
+
+type lightVolume struct {
+	height  int
+	opacity []uint8
+	sky     []uint8
+	block   []uint8
+	queue   []int32
+	heights []int
+	hasSky  bool
+}
+
+// Relight recomputes the sky and block light of the chunk from the opacity
+// and emission of blocks. neighbours are the chunks around it indexed by
+// [dx+1][dz+1], the middle one is ignored. Missing neighbours are treated as
+// air. Sky light is computed only if hasSky is set, the nether and the end
+// have none. It returns whether the light changed.
+func (c *Chunk_1_8_8) Relight(neighbours [3][3]*Chunk_1_8_8, hasSky bool) bool {
+	neighbours[1][1] = c
+
+	top := 0
+	for _, row := range neighbours {
+		for _, n := range row {
+			if n == nil {
+				continue
+			}
+			for i := range n.Sections {
+				if y := int(n.Sections[i].Y)<<4 + 16; y > top {
+					top = y
+				}
+			}
+		}
+	}
+	// Light may go around obstacles above the highest block
+	v := &lightVolume{height: top + 16, hasSky: hasSky}
+	if v.height > 256 {
+		v.height = 256
+	}
+	size := lightWindow * lightWindow * v.height
+	v.opacity = make([]uint8, size)
+	v.block = make([]uint8, size)
+	if hasSky {
+		v.sky = make([]uint8, size)
+	}
+
+	for dx, row := range neighbours {
+		for dz, n := range row {
+			if n != nil {
+				v.fill(n, dx<<4, dz<<4)
+			}
+		}
+	}
+	v.propagate(v.block)
+	if hasSky {
+		v.seedSky()
+		v.propagate(v.sky)
+	}
+
+	changed := v.store(c)
+	if c.LightPopulated != 1 {
+		c.LightPopulated = 1
+		changed = true
+	}
+	return changed
+}
+
+// StripLight removes the sky and block light of the chunk, leaving it to the
+// server to relight. It returns the number of bytes removed and whether the
+// chunk changed.
+func (c *Chunk_1_8_8) StripLight() (removed int, changed bool) {
+	for i := range c.Sections {
+		s := &c.Sections[i]
+		removed += len(s.SkyLight) + len(s.BlockLight)
+		s.SkyLight = nil
+		s.BlockLight = nil
+	}
+	changed = removed > 0 || c.LightPopulated != 0
+	c.LightPopulated = 0
+	return
+}
+
+func lightIndex(x, y, z int) int {
+	return (y*lightWindow+z)*lightWindow + x
+}
+
+// fill copies the opacity of blocks of the chunk to the volume and seeds the
+// block light of emitting blocks.
+func (v *lightVolume) fill(c *Chunk_1_8_8, ox, oz int) {
+	for i := range c.Sections {
+		s := &c.Sections[i]
+		baseY := int(s.Y) << 4
+		if baseY >= v.height {
+			continue
+		}
+		for idx := 0; idx < 4096; idx++ {
+			id := int(s.Blocks[idx])
+			if s.Add != nil {
+				id |= int(nibbleGet(s.Add, idx)) << 8
+			}
+			if id == 0 {
+				continue
+			}
+			vi := lightIndex(ox+idx&15, baseY+idx>>8, oz+(idx>>4)&15)
+			v.opacity[vi] = lightOpacity_1_8_8[id]
+			if e := lightEmission_1_8_8[id]; e > 0 {
+				v.block[vi] = e
+				v.queue = append(v.queue, int32(vi))
+			}
+		}
+	}
+}
+
+// seedSky lights the columns from the top down like the game does and
+// queues the cells next to darker columns.
+func (v *lightVolume) seedSky() {
+	v.heights = make([]int, lightWindow*lightWindow)
+	for z := 0; z < lightWindow; z++ {
+		for x := 0; x < lightWindow; x++ {
+			light := 15
+			y := v.height - 1
+			for ; y >= 0; y-- {
+				i := lightIndex(x, y, z)
+				opacity := int(v.opacity[i])
+				if opacity == 0 && light != 15 {
+					opacity = 1
+				}
+				light -= opacity
+				if light <= 0 {
+					break
+				}
+				v.sky[i] = uint8(light)
+				if light < 15 {
+					v.queue = append(v.queue, int32(i))
+				}
+			}
+			v.heights[z*lightWindow+x] = y + 1
+		}
+	}
+
+	// Full sky light spreads sideways under the blocks of neighbour columns
+	for z := 0; z < lightWindow; z++ {
+		for x := 0; x < lightWindow; x++ {
+			h := v.heights[z*lightWindow+x]
+			max := h
+			for _, d := range [4][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+				nx, nz := x+d[0], z+d[1]
+				if nx < 0 || nz < 0 || nx >= lightWindow || nz >= lightWindow {
+					continue
+				}
+				if nh := v.heights[nz*lightWindow+nx]; nh > max {
+					max = nh
+				}
+			}
+			for y := h; y < max; y++ {
+				if i := lightIndex(x, y, z); v.sky[i] == 15 {
+					v.queue = append(v.queue, int32(i))
+				}
+			}
+		}
+	}
+}
+
+// propagate spreads the light of the queued cells, losing the opacity of
+// every block passed and at least one level per block.
+func (v *lightVolume) propagate(light []uint8) {
+	const layer = lightWindow * lightWindow
+	for len(v.queue) > 0 {
+		i := int(v.queue[len(v.queue)-1])
+		v.queue = v.queue[:len(v.queue)-1]
+		level := int(light[i])
+		if level <= 1 {
+			continue
+		}
+		x, z, y := i%lightWindow, i/lightWindow%lightWindow, i/layer
+		for d := 0; d < 6; d++ {
+			n := i
+			switch d {
+			case 0:
+				if x == 0 {
+					continue
+				}
+				n--
+			case 1:
+				if x == lightWindow-1 {
+					continue
+				}
+				n++
+			case 2:
+				if z == 0 {
+					continue
+				}
+				n -= lightWindow
+			case 3:
+				if z == lightWindow-1 {
+					continue
+				}
+				n += lightWindow
+			case 4:
+				if y == 0 {
+					continue
+				}
+				n -= layer
+			case 5:
+				if y == v.height-1 {
+					continue
+				}
+				n += layer
+			}
+			opacity := int(v.opacity[n])
+			if opacity == 0 {
+				opacity = 1
+			}
+			if next := level - opacity; next > int(light[n]) {
+				light[n] = uint8(next)
+				v.queue = append(v.queue, int32(n))
+			}
+		}
+	}
+}
+
+// store writes the light of the middle chunk of the volume to its sections.
+func (v *lightVolume) store(c *Chunk_1_8_8) bool {
+	changed := false
+	for i := range c.Sections {
+		s := &c.Sections[i]
+		blockLight := make([]byte, 2048)
+		var skyLight []byte
+		if v.hasSky {
+			skyLight = make([]byte, 2048)
+		}
+		baseY := int(s.Y) << 4
+		for idx := 0; idx < 4096; idx++ {
+			y := baseY + idx>>8
+			if y >= v.height {
+				// Nothing but the open sky above the volume
+				if skyLight != nil {
+					nibbleSet(skyLight, idx, 15)
+				}
+				continue
+			}
+			vi := lightIndex(16+idx&15, y, 16+(idx>>4)&15)
+			nibbleSet(blockLight, idx, v.block[vi])
+			if skyLight != nil {
+				nibbleSet(skyLight, idx, v.sky[vi])
+			}
+		}
+		if !bytes.Equal(s.BlockLight, blockLight) {
+			s.BlockLight = blockLight
+			changed = true
+		}
+		if skyLight != nil && !bytes.Equal(s.SkyLight, skyLight) {
+			s.SkyLight = skyLight
+			changed = true
+		}
+	}
+	return changed
+}
+
+func nibbleSet(data []byte, idx int, value byte) {
+	shift := uint(idx&1) << 2
+	data[idx>>1] = data[idx>>1]&^(0x0F<<shift) | (value&0x0F)<<shift
+}
@@ -0,0 +1,217 @@
+package chunk
+
+import "testing"
+
+const (
+	lightStone     = 1
+	lightWater     = 9
+	lightLeaves    = 18
+	lightTorch     = 50
+	lightGlowstone = 89
+)
+
+// lightChunk returns a 1.8 chunk with a single section at the bottom, with
+// the blocks set by fn.
+func lightChunk(fn func(x, y, z int) byte) *Chunk_1_8_8 {
+	s := Section{Blocks: make([]byte, 4096), Data: make([]byte, 2048)}
+	for idx := range s.Blocks {
+		s.Blocks[idx] = fn(idx&15, idx>>8, idx>>4&15)
+	}
+	return &Chunk_1_8_8{Sections: []Section{s}}
+}
+
+// lightAt returns the light of the bottom section at the block.
+func lightAt(data []byte, x, y, z int) byte {
+	return nibbleGet(data, y<<8|z<<4|x)
+}
+
+func TestRelight_Overhang(t *testing.T) {
+	// A stone floor with a stone roof at y=10 over x=4..11, the neighbours
+	// are missing, so the open sky is around the chunk
+	c := lightChunk(func(x, y, z int) byte {
+		if y == 0 || y == 10 && x >= 4 && x <= 11 {
+			return lightStone
+		}
+		return 0
+	})
+	if !c.Relight([3][3]*Chunk_1_8_8{}, true) {
+		t.Error("light not changed")
+	}
+	sky, block := c.Sections[0].SkyLight, c.Sections[0].BlockLight
+	for z := 0; z < 16; z++ {
+		for x := 0; x < 16; x++ {
+			for y := 0; y < 16; y++ {
+				var want byte
+				switch {
+				case y == 0 || y == 10 && x >= 4 && x <= 11:
+				case y > 10 || x < 4 || x > 11:
+					want = 15
+				default:
+					// One level less per block from the nearest open column
+					dist := x - 3
+					for _, d := range []int{12 - x, z + 1, 16 - z} {
+						if d < dist {
+							dist = d
+						}
+					}
+					want = byte(15 - dist)
+				}
+				if got := lightAt(sky, x, y, z); got != want {
+					t.Errorf("sky light at %d %d %d is %d, want %d", x, y, z, got, want)
+				}
+				if got := lightAt(block, x, y, z); got != 0 {
+					t.Errorf("block light at %d %d %d is %d without light sources", x, y, z, got)
+				}
+			}
+		}
+	}
+	if c.LightPopulated != 1 {
+		t.Errorf("LightPopulated %d", c.LightPopulated)
+	}
+	if c.Relight([3][3]*Chunk_1_8_8{}, true) {
+		t.Error("light changed when relit again")
+	}
+}
+
+func TestRelight_Opacity(t *testing.T) {
+	// Leaves over water over air on stone, surrounded by the same chunks so
+	// no light comes from the sides
+	c := lightChunk(func(x, y, z int) byte {
+		switch {
+		case y < 4:
+			return lightStone
+		case y >= 8 && y < 12:
+			return lightWater
+		case y == 12:
+			return lightLeaves
+		}
+		return 0
+	})
+	var neighbours [3][3]*Chunk_1_8_8
+	for dx := range neighbours {
+		for dz := range neighbours[dx] {
+			neighbours[dx][dz] = c
+		}
+	}
+	c.Relight(neighbours, true)
+	// Leaves take one level, water three and air one below the first block
+	want := []byte{0, 0, 0, 0, 0, 0, 0, 1, 2, 5, 8, 11, 14, 15, 15, 15}
+	for x := 0; x < 16; x++ {
+		for z := 0; z < 16; z++ {
+			for y, want := range want {
+				if got := lightAt(c.Sections[0].SkyLight, x, y, z); got != want {
+					t.Errorf("sky light at %d %d %d is %d, want %d", x, y, z, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRelight_BlockLight(t *testing.T) {
+	for _, tc := range []struct {
+		block    byte
+		emission int
+	}{
+		{lightTorch, 14},
+		{lightGlowstone, 15},
+	} {
+		// A light source in a room closed by stone at x=12
+		c := lightChunk(func(x, y, z int) byte {
+			switch {
+			case x == 8 && y == 5 && z == 8:
+				return tc.block
+			case x == 12:
+				return lightStone
+			}
+			return 0
+		})
+		c.Relight([3][3]*Chunk_1_8_8{}, false)
+		block := c.Sections[0].BlockLight
+		for _, pos := range [][3]int{{8, 5, 8}, {8, 5, 11}, {6, 6, 8}, {8, 0, 7}, {1, 5, 8}, {0, 1, 2}, {11, 5, 8}} {
+			x, y, z := pos[0], pos[1], pos[2]
+			dist := x - 8
+			if dist < 0 {
+				dist = -dist
+			}
+			for _, d := range []int{y - 5, z - 8} {
+				if d < 0 {
+					d = -d
+				}
+				dist += d
+			}
+			want := tc.emission - dist
+			if want < 0 {
+				want = 0
+			}
+			if got := lightAt(block, x, y, z); int(got) != want {
+				t.Errorf("block %d: block light at %d %d %d is %d, want %d", tc.block, x, y, z, got, want)
+			}
+		}
+		// Around the stone wall
+		for _, pos := range [][3]int{{12, 5, 8}, {13, 5, 8}} {
+			if got := lightAt(block, pos[0], pos[1], pos[2]); got != 0 {
+				t.Errorf("block %d: block light at %v behind stone is %d", tc.block, pos, got)
+			}
+		}
+	}
+}
+
+func TestRelight_Neighbours(t *testing.T) {
+	air := func(x, y, z int) byte { return 0 }
+	c := lightChunk(air)
+	var neighbours [3][3]*Chunk_1_8_8
+	// A torch next to the east border, glowstone next to the west border
+	neighbours[2][1] = lightChunk(func(x, y, z int) byte {
+		if x == 0 && y == 5 && z == 8 {
+			return lightTorch
+		}
+		return 0
+	})
+	neighbours[0][1] = lightChunk(func(x, y, z int) byte {
+		if x == 15 && y == 5 && z == 3 {
+			return lightGlowstone
+		}
+		return 0
+	})
+	// The middle is the relit chunk whatever is passed
+	neighbours[1][1] = lightChunk(func(x, y, z int) byte { return lightStone })
+	c.Relight(neighbours, false)
+	block := c.Sections[0].BlockLight
+	for _, tc := range []struct {
+		x, y, z int
+		want    byte
+	}{
+		{15, 5, 8, 13},
+		{12, 5, 8, 10},
+		{15, 7, 9, 10},
+		{0, 5, 3, 14},
+		{3, 5, 3, 11},
+		{0, 5, 8, 9},
+	} {
+		if got := lightAt(block, tc.x, tc.y, tc.z); got != tc.want {
+			t.Errorf("block light at %d %d %d is %d, want %d", tc.x, tc.y, tc.z, got, tc.want)
+		}
+	}
+}
+
+func TestRelight_NoSky(t *testing.T) {
+	c := lightChunk(func(x, y, z int) byte {
+		if x == 8 && y == 5 && z == 8 {
+			return lightGlowstone
+		}
+		return 0
+	})
+	if !c.Relight([3][3]*Chunk_1_8_8{}, false) {
+		t.Error("light not changed")
+	}
+	s := c.Sections[0]
+	if s.SkyLight != nil {
+		t.Error("sky light set without a sky")
+	}
+	if got := lightAt(s.BlockLight, 8, 15, 8); got != 5 {
+		t.Errorf("block light at 8 15 8 is %d, want 5", got)
+	}
+	if got := lightAt(s.BlockLight, 0, 15, 0); got != 0 {
+		t.Errorf("block light at 0 15 0 is %d without the sky, want 0", got)
+	}
+}
@@ -0,0 +1,294 @@
+package chunk
+
+import (
+	"image/color"
+)
+
+// MapColors_1_8_8 are the base colors of maps, color 0 is not drawn.
+var MapColors_1_8_8 = [...]color.RGBA{
+	{0, 0, 0, 0},         // air
+	{127, 178, 56, 255},  // grass
+	{247, 233, 163, 255}, // sand
+	{199, 199, 199, 255}, // cloth
+	{255, 0, 0, 255},     // tnt
+	{160, 160, 255, 255}, // ice
+	{167, 167, 167, 255}, // iron
+	{0, 124, 0, 255},     // foliage
+	{255, 255, 255, 255}, // snow
+	{164, 168, 184, 255}, // clay
+	{151, 109, 77, 255},  // dirt
+	{112, 112, 112, 255}, // stone
+	{64, 64, 255, 255},   // water
+	{143, 119, 72, 255},  // wood
+	{255, 252, 245, 255}, // quartz
+	{216, 127, 51, 255},  // orange
+	{178, 76, 216, 255},  // magenta
+	{102, 153, 216, 255}, // light blue
+	{229, 229, 51, 255},  // yellow
+	{127, 204, 25, 255},  // lime
+	{242, 127, 165, 255}, // pink
+	{76, 76, 76, 255},    // gray
+	{153, 153, 153, 255}, // silver
+	{76, 127, 153, 255},  // cyan
+	{127, 63, 178, 255},  // purple
+	{51, 76, 178, 255},   // blue
+	{102, 76, 51, 255},   // brown
+	{102, 127, 51, 255},  // green
+	{153, 51, 51, 255},   // red
+	{25, 25, 25, 255},    // black
+	{250, 238, 77, 255},  // gold
+	{92, 219, 213, 255},  // diamond
+	{74, 128, 255, 255},  // lapis
+	{0, 217, 58, 255},    // emerald
+	{129, 86, 49, 255},   // obsidian
+	{112, 2, 0, 255},     // netherrack
+}
+
+const (
+	mapAir = iota
+	mapGrass
+	mapSand
+	mapCloth
+	mapTnt
+	mapIce
+	mapIron
+	mapFoliage
+	mapSnow
+	mapClay
+	mapDirt
+	mapStone
+	mapWater
+	mapWood
+	mapQuartz
+	mapOrange
+	mapMagenta
+	mapLightBlue
+	mapYellow
+	mapLime
+	mapPink
+	mapGray
+	mapSilver
+	mapCyan
+	mapPurple
+	mapBlue
+	mapBrown
+	mapGreen
+	mapRed
+	mapBlack
+	mapGold
+	mapDiamond
+	mapLapis
+	mapEmerald
+	mapObsidian
+	mapNetherrack
+)
+
+// mapDyed_1_8_8 lists the blocks colored by the dye of their data value.
+var mapDyed_1_8_8 = map[int]bool{35: true, 95: true, 159: true, 160: true, 171: true}
+
+// mapColor_1_8_8 maps block IDs to map colors, missing blocks are stone.
+var mapColor_1_8_8 = map[int]uint8{
+	0:   mapAir,
+	2:   mapGrass,
+	3:   mapDirt,
+	5:   mapWood,
+	6:   mapFoliage,
+	8:   mapWater,
+	9:   mapWater,
+	10:  mapTnt,
+	11:  mapTnt,
+	12:  mapSand,
+	17:  mapWood,
+	18:  mapFoliage,
+	19:  mapYellow,
+	20:  mapAir,
+	22:  mapLapis,
+	24:  mapSand,
+	25:  mapWood,
+	26:  mapCloth,
+	27:  mapAir,
+	28:  mapAir,
+	30:  mapCloth,
+	31:  mapFoliage,
+	32:  mapWood,
+	37:  mapFoliage,
+	38:  mapFoliage,
+	39:  mapFoliage,
+	40:  mapFoliage,
+	41:  mapGold,
+	42:  mapIron,
+	45:  mapRed,
+	46:  mapTnt,
+	47:  mapWood,
+	49:  mapBlack,
+	50:  mapAir,
+	51:  mapTnt,
+	53:  mapWood,
+	54:  mapWood,
+	55:  mapAir,
+	57:  mapDiamond,
+	58:  mapWood,
+	59:  mapFoliage,
+	60:  mapDirt,
+	63:  mapWood,
+	64:  mapWood,
+	65:  mapAir,
+	66:  mapAir,
+	68:  mapWood,
+	69:  mapAir,
+	71:  mapIron,
+	72:  mapWood,
+	75:  mapAir,
+	76:  mapAir,
+	77:  mapAir,
+	78:  mapSnow,
+	79:  mapIce,
+	80:  mapSnow,
+	81:  mapFoliage,
+	82:  mapClay,
+	83:  mapFoliage,
+	84:  mapDirt,
+	85:  mapWood,
+	86:  mapOrange,
+	87:  mapNetherrack,
+	88:  mapBrown,
+	89:  mapSand,
+	90:  mapAir,
+	91:  mapOrange,
+	92:  mapAir,
+	93:  mapAir,
+	94:  mapAir,
+	96:  mapWood,
+	97:  mapClay,
+	99:  mapDirt,
+	100: mapRed,
+	101: mapIron,
+	102: mapAir,
+	103: mapLime,
+	104: mapFoliage,
+	105: mapFoliage,
+	106: mapFoliage,
+	107: mapWood,
+	108: mapRed,
+	110: mapPurple,
+	111: mapFoliage,
+	112: mapNetherrack,
+	113: mapNetherrack,
+	114: mapNetherrack,
+	115: mapRed,
+	116: mapRed,
+	117: mapIron,
+	118: mapIron,
+	119: mapAir,
+	120: mapGreen,
+	121: mapSand,
+	122: mapBlack,
+	123: mapAir,
+	124: mapAir,
+	125: mapWood,
+	126: mapWood,
+	127: mapFoliage,
+	128: mapSand,
+	131: mapAir,
+	132: mapAir,
+	133: mapEmerald,
+	134: mapWood,
+	135: mapWood,
+	136: mapWood,
+	137: mapBrown,
+	138: mapDiamond,
+	140: mapAir,
+	141: mapFoliage,
+	142: mapFoliage,
+	143: mapAir,
+	144: mapAir,
+	145: mapIron,
+	146: mapWood,
+	147: mapGold,
+	148: mapIron,
+	149: mapAir,
+	150: mapAir,
+	151: mapWood,
+	152: mapTnt,
+	153: mapNetherrack,
+	154: mapIron,
+	155: mapQuartz,
+	156: mapQuartz,
+	157: mapAir,
+	161: mapFoliage,
+	162: mapWood,
+	163: mapWood,
+	164: mapWood,
+	165: mapGrass,
+	166: mapAir,
+	167: mapIron,
+	168: mapCyan,
+	169: mapQuartz,
+	170: mapYellow,
+	172: mapOrange,
+	173: mapBlack,
+	174: mapIce,
+	175: mapFoliage,
+	176: mapWood,
+	177: mapWood,
+	178: mapWood,
+	179: mapOrange,
+	180: mapOrange,
+	181: mapOrange,
+	182: mapOrange,
+	183: mapWood,
+	184: mapWood,
+	185: mapWood,
+	186: mapWood,
+	187: mapWood,
+	188: mapWood,
+	189: mapWood,
+	190: mapWood,
+	191: mapWood,
+	192: mapWood,
+	193: mapWood,
+	194: mapWood,
+	195: mapWood,
+	196: mapWood,
+	197: mapWood,
+}
+
+// mapDyeColors_1_8_8 are the map colors of the dyes by data value.
+var mapDyeColors_1_8_8 = [16]uint8{
+	mapSnow, mapOrange, mapMagenta, mapLightBlue, mapYellow, mapLime, mapPink, mapGray,
+	mapSilver, mapCyan, mapPurple, mapBlue, mapBrown, mapGreen, mapRed, mapBlack,
+}
+
+func mapColor(id int, data byte) uint8 {
+	if mapDyed_1_8_8[id] {
+		return mapDyeColors_1_8_8[data&15]
+	}
+	if color, ok := mapColor_1_8_8[id]; ok {
+		return color
+	}
+	return mapStone
+}
+
+// MapColumn returns the height and the map color of the column as drawn on
+// maps, and the depth of the water for water columns. The color is 0 if
+// nothing is drawn.
+func (c *Chunk_1_8_8) MapColumn(x, z int) (y int, color uint8, depth int) {
+	y, id, data := c.Surface(x, z)
+	for ; y >= 0; y-- {
+		id, data = c.GetType(x, y, z)
+		if color = mapColor(id, data); color != mapAir {
+			break
+		}
+	}
+	if y < 0 {
+		return -1, mapAir, 0
+	}
+	if color == mapWater {
+		for depth = 1; y-depth >= 0; depth++ {
+			if id, _ := c.GetType(x, y-depth, z); id != 8 && id != 9 {
+				break
+			}
+		}
+	}
+	return y, color, depth
+}
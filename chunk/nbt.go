@@ -0,0 +1,168 @@
+package chunk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Tnze/go-mc/nbt"
+)
+
+// Extra holds the tags of a compound which have no field in the struct the
+// compound is decoded into. They are written back unchanged, so tags unknown
+// to this package (scheduled ticks, modded or plugin data) survive a
+// Load/Save round trip.
+type Extra map[string]nbt.RawMessage
+
+// unmarshalCompound decodes a compound tag into the struct pointed by v and
+// returns the tags that have no matching field.
+func unmarshalCompound(tagType byte, r nbt.DecoderReader, v interface{}) (Extra, error) {
+	if tagType != nbt.TagCompound {
+		return nil, fmt.Errorf("cannot parse tag 0x%02x as compound", tagType)
+	}
+	val := reflect.ValueOf(v).Elem()
+	fields := tagFields(val.Type())
+
+	var extra Extra
+	for {
+		tt, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if tt == nbt.TagEnd {
+			break
+		}
+		var nameLen uint16
+		if err = binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+			return nil, err
+		}
+		name := make([]byte, nameLen)
+		if _, err = io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+
+		var raw nbt.RawMessage
+		if err = raw.UnmarshalNBT(tt, r); err != nil {
+			return nil, fmt.Errorf("fail to decode tag %q: %w", name, err)
+		}
+		if i, ok := fields[string(name)]; ok {
+			if err = raw.Unmarshal(val.Field(i).Addr().Interface()); err != nil {
+				return nil, fmt.Errorf("fail to decode tag %q: %w", name, err)
+			}
+			continue
+		}
+		if extra == nil {
+			extra = make(Extra)
+		}
+		extra[string(name)] = raw
+	}
+	return extra, nil
+}
+
+// marshalCompound writes the payload of a compound tag built from the fields
+// of the struct v followed by the extra tags. Nil pointers and raw messages
+// without a type are treated as missing tags.
+func marshalCompound(w io.Writer, v interface{}, extra Extra) error {
+	val := reflect.Indirect(reflect.ValueOf(v))
+	t := val.Type()
+	enc := nbt.NewEncoder(w)
+	for i := 0; i < t.NumField(); i++ {
+		name, omitEmpty, ok := tagName(t.Field(i))
+		if !ok {
+			continue
+		}
+		field := val.Field(i)
+		if field.Kind() == reflect.Pointer && field.IsNil() {
+			continue
+		}
+		if omitEmpty && isEmptyValue(field) {
+			continue
+		}
+		if raw, ok := field.Interface().(nbt.RawMessage); ok && raw.Type == nbt.TagEnd {
+			continue
+		}
+		if err := enc.Encode(field.Interface(), name); err != nil {
+			return fmt.Errorf("write tag %q: %w", name, err)
+		}
+	}
+
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		raw := extra[name]
+		header := make([]byte, 0, 3+len(name))
+		header = append(header, raw.Type)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(name)))
+		header = append(header, name...)
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(raw.Data); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{nbt.TagEnd})
+	return err
+}
+
+// tagName returns the tag name of a struct field and whether it has the
+// omitempty option. ok is false for fields which are not encoded.
+func tagName(f reflect.StructField) (name string, omitEmpty, ok bool) {
+	tag := f.Tag.Get("nbt")
+	if f.PkgPath != "" || tag == "-" {
+		return "", false, false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name, opts == "omitempty", true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+var tagFieldsCache sync.Map
+
+// tagFields maps tag names to field indices of the struct type t, matching
+// fields by the name in the nbt struct tag or by the field name like the nbt
+// package does.
+func tagFields(t reflect.Type) map[string]int {
+	if fields, ok := tagFieldsCache.Load(t); ok {
+		return fields.(map[string]int)
+	}
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name, _, ok := tagName(f); ok {
+			fields[name] = i
+			if _, ok := fields[f.Name]; !ok {
+				fields[f.Name] = i
+			}
+		}
+	}
+	tagFieldsCache.Store(t, fields)
+	return fields
+}
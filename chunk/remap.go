@@ -0,0 +1,69 @@
+package chunk
+
+// BlockRemap substitutes blocks of 1.8 chunks by their IDs and data values.
+// The zero value keeps every block.
+type BlockRemap struct {
+	// table holds the new id<<4|data xor the old one by the old one, so
+	// blocks without a mapping hold 0
+	table [4096 << 4]uint16
+}
+
+func NewBlockRemap() *BlockRemap {
+	return new(BlockRemap)
+}
+
+// Set maps the block to another. fromData below 0 matches any data value,
+// toData below 0 keeps the data value. Air always gets data 0.
+func (m *BlockRemap) Set(fromID, fromData, toID, toData int) {
+	for data := 0; data < 16; data++ {
+		if fromData >= 0 && data != fromData {
+			continue
+		}
+		newData := toData
+		if newData < 0 {
+			newData = data
+		}
+		if toID == 0 {
+			newData = 0
+		}
+		m.table[fromID<<4|data] = uint16(toID<<4|newData) ^ uint16(fromID<<4|data)
+	}
+}
+
+// Remap substitutes the blocks of the chunk and returns the number of
+// changed blocks. A nil remap keeps every block.
+func (c *Chunk_1_8_8) Remap(m *BlockRemap) int {
+	if m == nil {
+		return 0
+	}
+	changed := 0
+	for i := range c.Sections {
+		s := &c.Sections[i]
+		before := changed
+		for idx := 0; idx < 4096; idx++ {
+			id := int(s.Blocks[idx])
+			if s.Add != nil {
+				id |= int(nibbleGet(s.Add, idx)) << 8
+			}
+			data := nibbleGet(s.Data, idx)
+			state := id<<4 | int(data)
+			next := int(m.table[state]) ^ state
+			if next == state {
+				continue
+			}
+			changed++
+			s.Blocks[idx] = byte(next >> 4)
+			if next>>12 != 0 && s.Add == nil {
+				s.Add = make([]byte, 2048)
+			}
+			if s.Add != nil {
+				nibbleSet(s.Add, idx, byte(next>>12))
+			}
+			nibbleSet(s.Data, idx, byte(next&15))
+		}
+		if changed > before && s.Add != nil && isZero(s.Add) {
+			s.Add = nil
+		}
+	}
+	return changed
+}
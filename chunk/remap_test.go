@@ -0,0 +1,45 @@
+package chunk
+
+import "testing"
+
+func TestBlockRemap(t *testing.T) {
+	newChunk := func() *Chunk_1_8_8 {
+		s := Section{Blocks: make([]byte, 4096), Data: make([]byte, 2048)}
+		for idx := range s.Blocks {
+			s.Blocks[idx] = byte(idx % 3)
+		}
+		nibbleSet(s.Data, 0, 5)
+		return &Chunk_1_8_8{Sections: []Section{s}}
+	}
+
+	var zero BlockRemap
+	if n := newChunk().Remap(&zero); n != 0 {
+		t.Errorf("zero remap changed %d blocks", n)
+	}
+	if n := newChunk().Remap(nil); n != 0 {
+		t.Errorf("nil remap changed %d blocks", n)
+	}
+
+	m := NewBlockRemap()
+	m.Set(1, -1, 300, 2)
+	m.Set(0, 5, 2, -1)
+	c := newChunk()
+	if n := c.Remap(m); n != 1366 {
+		t.Errorf("remap changed %d blocks, want 1366", n)
+	}
+	for _, tc := range []struct {
+		idx   int
+		id    int
+		data  byte
+		block string
+	}{
+		{0, 2, 5, "air with data 5"},
+		{1, 300, 2, "stone"},
+		{2, 2, 0, "grass"},
+		{3, 0, 0, "air"},
+	} {
+		if id, data := c.GetType(tc.idx, 0, 0); id != tc.id || data != tc.data {
+			t.Errorf("%s remapped to %d:%d, want %d:%d", tc.block, id, data, tc.id, tc.data)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package chunk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Tnze/go-mc/nbt"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+)
+
+// Chunk is a terrain chunk stored in a region file.
+type Chunk interface {
+	// Pos returns the absolute chunk coordinates stored in the chunk, ok is
+	// false if they are missing.
+	Pos() (x, z int, ok bool)
+	// Inhabited returns the number of ticks players spent in the chunk.
+	Inhabited() int64
+	HasTileEntities() bool
+	IsEmpty() bool
+	// Optimize removes empty sections and returns their number.
+	Optimize() int
+	ComputeHeightMap() bool
+	ComputeLowMap() []byte
+	Save() ([]byte, error)
+}
+
+// Load decodes a region file sector. The chunk implementation is picked by
+// the DataVersion of the chunk: chunks without it or older than 1.13 use
+// the numeric block ids of Chunk_1_8_8, newer ones Chunk_1_13.
+func Load(data []byte) (Chunk, error) {
+	raw, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		DataVersion int32
+	}
+	if err = nbt.Unmarshal(raw, &header); err != nil {
+		return nil, err
+	}
+	if header.DataVersion < dataVersion_1_13 {
+		c := new(Chunk_1_8_8)
+		return c, c.decode(raw)
+	}
+	c := new(Chunk_1_13)
+	return c, c.decode(raw)
+}
+
+// chunkPos returns the chunk coordinates of the xPos and zPos tags, ok is
+// false if one of them is missing.
+func chunkPos(xPos, zPos *int32) (x, z int, ok bool) {
+	if xPos == nil || zPos == nil {
+		return 0, 0, false
+	}
+	return int(*xPos), int(*zPos), true
+}
+
+// decompress returns the NBT data of a region file sector.
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty sector")
+	}
+	var r io.Reader = bytes.NewReader(data[1:])
+
+	switch data[0] {
+	default:
+		return nil, errors.New("unknown compression")
+	case 1:
+		var zr *gzip.Reader
+		var err error
+		if pooled := gzipReaderPool.Get(); pooled != nil {
+			zr = pooled.(*gzip.Reader)
+			err = zr.Reset(r)
+		} else {
+			zr, err = gzip.NewReader(r)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReaderPool.Put(zr)
+		r = zr
+	case 2:
+		var zr io.ReadCloser
+		var err error
+		if pooled := zlibReaderPool.Get(); pooled != nil {
+			zr = pooled.(io.ReadCloser)
+			err = zr.(zlib.Resetter).Reset(r, nil)
+		} else {
+			zr, err = zlib.NewReader(r)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer zlibReaderPool.Put(zr)
+		r = zr
+	case 3:
+		return data[1:], nil
+	}
+
+	var buf bytes.Buffer
+	// Chunks written by older versions of this tool lack the zlib trailer
+	if _, err := buf.ReadFrom(r); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeSector encodes v as the root tag of a zlib compressed sector.
+func encodeSector(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(2)
+
+	var w *zlib.Writer
+	if pooled := zlibWriterPool.Get(); pooled != nil {
+		w = pooled.(*zlib.Writer)
+		w.Reset(&buf)
+	} else {
+		w = zlib.NewWriter(&buf)
+	}
+	defer zlibWriterPool.Put(w)
+
+	err := nbt.NewEncoder(w).Encode(v, "")
+	if err != nil {
+		return nil, fmt.Errorf("write chunk: %w", err)
+	}
+	err = w.Close()
+	return buf.Bytes(), err
+}
+
+// Pools are shared between goroutines, so chunks of different
+// regions can be decoded and encoded concurrently.
+var gzipReaderPool sync.Pool
+var zlibReaderPool sync.Pool
+var zlibWriterPool sync.Pool
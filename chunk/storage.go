@@ -0,0 +1,52 @@
+package chunk
+
+import (
+	"github.com/Tnze/go-mc/nbt"
+)
+
+// EntityChunk is a chunk of the entities folder, used since 1.17.
+type EntityChunk struct {
+	DataVersion int32
+	Position    []int32
+	Entities    *nbt.RawMessage
+}
+
+func LoadEntities(data []byte) (*EntityChunk, error) {
+	raw, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	c := new(EntityChunk)
+	return c, nbt.Unmarshal(raw, c)
+}
+
+func (c *EntityChunk) IsEmpty() bool {
+	return isEmptyList(c.Entities)
+}
+
+// PoiChunk is a chunk of the poi folder with points of interest like beds
+// and workstations, used since 1.14.
+type PoiChunk struct {
+	DataVersion int32
+	Sections    map[string]struct {
+		Records *nbt.RawMessage
+	}
+}
+
+func LoadPoi(data []byte) (*PoiChunk, error) {
+	raw, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	c := new(PoiChunk)
+	return c, nbt.Unmarshal(raw, c)
+}
+
+func (c *PoiChunk) IsEmpty() bool {
+	for _, section := range c.Sections {
+		if !isEmptyList(section.Records) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package chunk
+
+import (
+	"github.com/Tnze/go-mc/nbt"
+)
+
+// tileEntityBlocks_1_8_8 lists the blocks tile entities belong to by their
+// IDs.
+var tileEntityBlocks_1_8_8 = map[string][]int{
+	"Airportal":    {119},
+	"Banner":       {176, 177},
+	"Beacon":       {138},
+	"Cauldron":     {117},
+	"Chest":        {54, 146},
+	"Comparator":   {149, 150},
+	"Control":      {137},
+	"DLDetector":   {151, 178},
+	"Dropper":      {158},
+	"EnchantTable": {116},
+	"EnderChest":   {130},
+	"FlowerPot":    {140},
+	"Furnace":      {61, 62},
+	"Hopper":       {154},
+	"MobSpawner":   {52},
+	"Music":        {25},
+	"Piston":       {36},
+	"RecordPlayer": {84},
+	"Sign":         {63, 68},
+	"Skull":        {144},
+	"Trap":         {23},
+}
+
+// RemovedTileEntity describes a tile entity removed by CleanTileEntities.
+type RemovedTileEntity struct {
+	Id     string `json:"id"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Z      int    `json:"z"`
+	Reason string `json:"reason"`
+}
+
+// CleanTileEntities removes tile entities outside the chunk, tile entities
+// of known types standing where the block doesn't match and all but the
+// last of tile entities at the same position, as the game keeps the last.
+func (c *Chunk_1_8_8) CleanTileEntities() ([]RemovedTileEntity, error) {
+	if len(c.TileEntities.Data) <= 5 {
+		return nil, nil
+	}
+	var tileEntities []nbt.RawMessage
+	if err := c.TileEntities.Unmarshal(&tileEntities); err != nil {
+		return nil, err
+	}
+
+	type position struct{ x, y, z int }
+	parsed := make([]RemovedTileEntity, len(tileEntities))
+	last := make(map[position]int)
+	for i, raw := range tileEntities {
+		var te struct {
+			Id string `nbt:"id"`
+			X  int32  `nbt:"x"`
+			Y  int32  `nbt:"y"`
+			Z  int32  `nbt:"z"`
+		}
+		if err := raw.Unmarshal(&te); err != nil {
+			return nil, err
+		}
+		parsed[i] = RemovedTileEntity{Id: te.Id, X: int(te.X), Y: int(te.Y), Z: int(te.Z)}
+		last[position{int(te.X), int(te.Y), int(te.Z)}] = i
+	}
+
+	x, z, hasPos := c.Pos()
+	var removed []RemovedTileEntity
+	kept := tileEntities[:0]
+	for i, raw := range tileEntities {
+		te := parsed[i]
+		switch {
+		case hasPos && (te.X>>4 != x || te.Z>>4 != z) || te.Y < 0 || te.Y > 255:
+			te.Reason = "outside chunk"
+		case last[position{te.X, te.Y, te.Z}] != i:
+			te.Reason = "duplicate"
+		case !c.tileEntityMatches(te):
+			te.Reason = "block mismatch"
+		default:
+			kept = append(kept, raw)
+			continue
+		}
+		removed = append(removed, te)
+	}
+
+	if removed != nil {
+		c.TileEntities = compoundList(kept)
+	}
+	return removed, nil
+}
+
+func (c *Chunk_1_8_8) tileEntityMatches(te RemovedTileEntity) bool {
+	blocks, ok := tileEntityBlocks_1_8_8[te.Id]
+	if !ok {
+		// Unknown and modded tile entities are left alone
+		return true
+	}
+	id, _ := c.GetType(te.X&15, te.Y, te.Z&15)
+	for _, block := range blocks {
+		if id == block {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package chunk
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Tnze/go-mc/nbt"
+)
+
+// tileEntityChunk returns a decoded 1.8 chunk at 3 -2 with a chest at 1 5 2,
+// a furnace at 2 5 2 and a sign at 3 6 2, and the tile entities numbered by
+// their index in the tag N.
+func tileEntityChunk(t *testing.T, hasPos bool, tileEntities ...map[string]interface{}) *Chunk_1_8_8 {
+	t.Helper()
+	for i, te := range tileEntities {
+		te["N"] = int32(i)
+	}
+	tags := chunk_1_8_8(section_1_8_8(0, func(x, y, z int) byte {
+		switch {
+		case x == 1 && y == 5 && z == 2:
+			return 54
+		case x == 2 && y == 5 && z == 2:
+			return 61
+		case x == 3 && y == 6 && z == 2:
+			return 63
+		}
+		return 0
+	}))
+	level := tags["Level"].(map[string]interface{})
+	level["TileEntities"] = tileEntities
+	if !hasPos {
+		delete(level, "xPos")
+		delete(level, "zPos")
+	}
+	raw, err := nbt.Marshal(tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := new(Chunk_1_8_8)
+	if err := c.decode(raw); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func tileEntity(id string, x, y, z int32) map[string]interface{} {
+	return map[string]interface{}{"id": id, "x": x, "y": y, "z": z}
+}
+
+// keptTileEntities returns the numbers of the tile entities of the chunk.
+func keptTileEntities(t *testing.T, c *Chunk_1_8_8) []int32 {
+	t.Helper()
+	var kept []struct{ N int32 }
+	if err := c.TileEntities.Unmarshal(&kept); err != nil {
+		t.Fatal(err)
+	}
+	var numbers []int32
+	for _, te := range kept {
+		numbers = append(numbers, te.N)
+	}
+	return numbers
+}
+
+func TestCleanTileEntities(t *testing.T) {
+	c := tileEntityChunk(t, true,
+		tileEntity("Chest", 49, 5, -30),
+		tileEntity("Chest", 52, 5, -30),
+		tileEntity("Sign", 64, 6, -30),
+		tileEntity("Sign", 51, 6, -30),
+		tileEntity("Sign", 51, 6, -30),
+		tileEntity("Furnace", 50, 5, -30),
+		tileEntity("ModThing", 52, 5, -29),
+		tileEntity("Chest", 49, 300, -30),
+		tileEntity("Chest", 49, 5, -33),
+	)
+	removed, err := c.CleanTileEntities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RemovedTileEntity{
+		{Id: "Chest", X: 52, Y: 5, Z: -30, Reason: "block mismatch"},
+		{Id: "Sign", X: 64, Y: 6, Z: -30, Reason: "outside chunk"},
+		{Id: "Sign", X: 51, Y: 6, Z: -30, Reason: "duplicate"},
+		{Id: "Chest", X: 49, Y: 300, Z: -30, Reason: "outside chunk"},
+		{Id: "Chest", X: 49, Y: 5, Z: -33, Reason: "outside chunk"},
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v,\nwant %v", removed, want)
+	}
+	// The last of the duplicates and unknown tile entities are kept
+	if got, want := keptTileEntities(t, c), []int32{0, 4, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+
+	removed, err = c.CleanTileEntities()
+	if removed != nil || err != nil {
+		t.Errorf("removed again %v, %v", removed, err)
+	}
+}
+
+func TestCleanTileEntities_NoPosition(t *testing.T) {
+	// Without a stored position only the height is checked
+	c := tileEntityChunk(t, false,
+		tileEntity("Chest", 1009, 5, 1010),
+		tileEntity("Chest", 1009, -1, 1010),
+		tileEntity("Furnace", 1010, 5, 1010),
+	)
+	removed, err := c.CleanTileEntities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RemovedTileEntity{{Id: "Chest", X: 1009, Y: -1, Z: 1010, Reason: "outside chunk"}}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v,\nwant %v", removed, want)
+	}
+	if got, want := keptTileEntities(t, c), []int32{0, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
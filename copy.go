@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// copyFile copies a file of the disk by a hard link if link is set, else by
+// a reflink where the file system supports it, or by streaming its content.
+// Hard linked files share later changes with the original.
+func copyFile(src, dst string, perm os.FileMode, link bool) error {
+	if link && os.Link(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if reflink(out, in) == nil {
+		return out.Close()
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeFile streams a file of the file system to a temporary file next to the
+// destination, then renames it over the destination.
+func writeFile(fs afero.Fs, path, dst string, perm os.FileMode) error {
+	tmp, err := writeTemp(fs, path, dst, perm)
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// writeTemp streams a file of the file system to the temporary file of the
+// destination and syncs it to the disk.
+func writeTemp(fs afero.Fs, path, dst string, perm os.FileMode) (string, error) {
+	tmp := tempPath(dst)
+	in, err := fs.Open(path)
+	if err != nil {
+		return tmp, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return tmp, err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	return tmp, err
+}
+
+// replaceFile renames the file over the original, keeping the permissions of
+// the original.
+func replaceFile(file, original string) error {
+	stat, err := os.Stat(original)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(file, stat.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(file, original)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// sameFile reports whether the paths are links of the same file.
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	infoA, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without reflinks, like on ext4 or tmpfs, the content is streamed
+	copied := filepath.Join(dir, "copied")
+	if err := copyFile(src, copied, 0640, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(copied); err != nil || string(data) != "content" {
+		t.Errorf("copied file %q, %v", data, err)
+	}
+	if sameFile(t, src, copied) {
+		t.Error("copied file linked to the source")
+	}
+
+	linked := filepath.Join(dir, "linked")
+	if err := copyFile(src, linked, 0640, true); err != nil {
+		t.Fatal(err)
+	}
+	if !sameFile(t, src, linked) {
+		t.Error("linked file is a copy")
+	}
+
+	if err := copyFile(src, copied, 0640, false); err == nil {
+		t.Error("existing file overwritten")
+	}
+}
+
+func TestSaveCopy(t *testing.T) {
+	defer func(o bool, l bool) { *overwrite, *hardLink = o, l }(*overwrite, *hardLink)
+	*overwrite = false
+
+	for _, link := range []bool{false, true} {
+		*hardLink = link
+		dir, s, original, changed := newChangedWorld(t)
+		if err := s.Save(); err != nil {
+			t.Fatal(err)
+		}
+		out := dir + *suffix
+		if got := osTree(t, out); !reflect.DeepEqual(got, changed) {
+			t.Errorf("link %v: copy of the world:\n got %v\nwant %v", link, got, changed)
+		}
+		if got := osTree(t, dir); !reflect.DeepEqual(got, original) {
+			t.Errorf("link %v: world changed by the copy:\n got %v\nwant %v", link, got, original)
+		}
+		if _, err := os.Stat(filepath.Join(out, "gone")); err == nil {
+			t.Errorf("link %v: removed file copied", link)
+		}
+
+		if got := sameFile(t, filepath.Join(dir, "level.dat"), filepath.Join(out, "level.dat")); got != link {
+			t.Errorf("link %v: unchanged file linked: %v", link, got)
+		}
+		if sameFile(t, filepath.Join(dir, "region/r.0.0.mca"), filepath.Join(out, "region/r.0.0.mca")) {
+			t.Errorf("link %v: changed file linked", link)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CropArea is the area of a world kept by cropping, either a box of chunks
+// or a radius around the spawn.
+type CropArea struct {
+	// MinX, MinZ, MaxX and MaxZ bound the box of chunks, inclusive.
+	MinX, MinZ, MaxX, MaxZ int
+	// Radius in blocks around the spawn. If positive, the box is ignored.
+	Radius int
+}
+
+// CropChunks returns the area of chunks between two corners, inclusive.
+func CropChunks(x1, z1, x2, z2 int) *CropArea {
+	if x1 > x2 {
+		x1, x2 = x2, x1
+	}
+	if z1 > z2 {
+		z1, z2 = z2, z1
+	}
+	return &CropArea{MinX: x1, MinZ: z1, MaxX: x2, MaxZ: z2}
+}
+
+// CropBlocks returns the area of chunks touched by the box between two block
+// corners, inclusive.
+func CropBlocks(x1, z1, x2, z2 int) *CropArea {
+	return CropChunks(x1>>4, z1>>4, x2>>4, z2>>4)
+}
+
+// CropSpawn returns the area of chunks touched by the circle around the spawn.
+func CropSpawn(radius int) *CropArea {
+	return &CropArea{Radius: radius}
+}
+
+func (o *WorldOptimizer) cropFilter(worldDir string) (chunkFilter, error) {
+	area := o.Crop
+	if area.Radius <= 0 {
+		return area.containsChunk, nil
+	}
+
+	level, err := readLevel(o.fs(), worldDir)
+	if err != nil {
+		return nil, err
+	}
+	x, z := int(level.Data.SpawnX), int(level.Data.SpawnZ)
+	return func(pos ChunkPos) bool {
+		// Distance to the nearest block of the chunk
+		dx := clamp(x, pos.X<<4, pos.X<<4+15) - x
+		dz := clamp(z, pos.Z<<4, pos.Z<<4+15) - z
+		return dx*dx+dz*dz <= area.Radius*area.Radius
+	}, nil
+}
+
+// containsChunk reports whether the chunk is inside the box.
+func (a *CropArea) containsChunk(pos ChunkPos) bool {
+	return pos.X >= a.MinX && pos.X <= a.MaxX && pos.Z >= a.MinZ && pos.Z <= a.MaxZ
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// parseBox parses two corners written as x1,z1,x2,z2.
+func parseBox(s string) (x1, z1, x2, z2 int, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return 0, 0, 0, 0, fmt.Errorf("invalid box %q, expected x1,z1,x2,z2", s)
+	}
+	var v [4]int
+	for i, part := range parts {
+		if v[i], err = strconv.Atoi(strings.TrimSpace(part)); err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("invalid box %q: %w", s, err)
+		}
+	}
+	return v[0], v[1], v[2], v[3], nil
+}
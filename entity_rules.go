@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"mc-world-trimmer/chunk"
+)
+
+// loadEntityRules reads entity rules from a JSON file. The name "default"
+// stands for chunk.DefaultEntityRules.
+func loadEntityRules(path string) (*chunk.EntityRules, error) {
+	if path == "default" {
+		rules := chunk.DefaultEntityRules
+		return &rules, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := new(chunk.EntityRules)
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func countEntities(entities map[string]int) int {
+	n := 0
+	for _, count := range entities {
+		n += count
+	}
+	return n
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+
+	"mc-world-trimmer/chunk"
+)
+
+// chunkFilter reports whether the chunk at the absolute position is kept.
+type chunkFilter func(pos ChunkPos) bool
+
+// chunkFilters are named filters. A chunk is kept if all of them keep it.
+type chunkFilters []namedFilter
+
+type namedFilter struct {
+	name string
+	keep chunkFilter
+}
+
+// removedBy returns the name of the first filter removing the chunk at the
+// absolute position, or an empty string if the chunk is kept.
+func (f chunkFilters) removedBy(pos ChunkPos) string {
+	for _, filter := range f {
+		if !filter.keep(pos) {
+			return filter.name
+		}
+	}
+	return ""
+}
+
+// keepFilters returns the filters of chunks kept in the dimension folder dir
+// of the world worldDir. The spawn is in the overworld, filters around it are
+// left out of the nether and the end.
+func (o *WorldOptimizer) keepFilters(worldDir, dir string) (chunkFilters, error) {
+	overworld := dir == worldDir
+	var filters chunkFilters
+	if o.MinInhabitedTime > 0 {
+		filter, err := o.inhabitedFilter(worldDir, dir)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, namedFilter{"inhabited time", filter})
+	}
+	if o.Crop != nil && (o.Crop.Radius <= 0 || overworld) {
+		filter, err := o.cropFilter(worldDir)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, namedFilter{"crop", filter})
+	}
+	if o.Mask != nil {
+		filters = append(filters, namedFilter{"mask", o.Mask.Keeps})
+	}
+	if o.WorldGuardPath != "" {
+		mask, err := o.worldGuardMask(worldDir, dir)
+		if err != nil {
+			return nil, err
+		}
+		if mask != nil {
+			filters = append(filters, namedFilter{"WorldGuard regions", mask.Keeps})
+		}
+	}
+	return filters, nil
+}
+
+// inhabitedFilter keeps chunks players spent at least MinInhabitedTime ticks
+// in, chunks with tile entities and chunks near the spawn of the overworld,
+// along with a margin of KeepMargin chunks around them.
+func (o *WorldOptimizer) inhabitedFilter(worldDir, dir string) (chunkFilter, error) {
+	kept, err := o.scanRegions(dir, "region", func(pos ChunkPos, sector []byte) (ChunkPos, bool, error) {
+		c, err := chunk.Load(sector)
+		if err != nil {
+			return pos, false, err
+		}
+		return storedPos(c, pos), c.Inhabited() >= o.MinInhabitedTime || c.HasTileEntities(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if o.SpawnRadius > 0 && dir == worldDir {
+		level, err := readLevel(o.fs(), worldDir)
+		if err != nil {
+			return nil, err
+		}
+		spawn := level.SpawnChunk()
+		for _, pos := range chunksInRadius(spawn, o.SpawnRadius) {
+			kept[pos] = true
+		}
+	}
+
+	if o.KeepMargin > 0 {
+		dilated := make(map[ChunkPos]bool, len(kept))
+		for pos := range kept {
+			for x := pos.X - o.KeepMargin; x <= pos.X+o.KeepMargin; x++ {
+				for z := pos.Z - o.KeepMargin; z <= pos.Z+o.KeepMargin; z++ {
+					dilated[ChunkPos{x, z}] = true
+				}
+			}
+		}
+		kept = dilated
+	}
+
+	if *verbose {
+		o.log(dir, "inhabited chunks kept", fmt.Sprint(len(kept)))
+	}
+	return func(pos ChunkPos) bool {
+		return kept[pos]
+	}, nil
+}
+
+// chunksInRadius returns the chunks within radius chunks of the center.
+func chunksInRadius(center ChunkPos, radius int) []ChunkPos {
+	var chunks []ChunkPos
+	for dx := -radius; dx <= radius; dx++ {
+		for dz := -radius; dz <= radius; dz++ {
+			if dx*dx+dz*dz <= radius*radius {
+				chunks = append(chunks, ChunkPos{center.X + dx, center.Z + dz})
+			}
+		}
+	}
+	return chunks
+}
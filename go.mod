@@ -7,6 +7,7 @@ require (
 	github.com/dustin/go-humanize v1.0.0
 	github.com/klauspost/compress v1.16.5
 	github.com/spf13/afero v1.8.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/text v0.3.4 // indirect
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mc-world-trimmer/lowmap"
+)
+
+// lowMapStats describes the columns of a low map.
+type lowMapStats struct {
+	chunks       int
+	minX, minZ   int
+	maxX, maxZ   int
+	columns      int
+	emptyColumns int
+	// mismatched columns are empty but not marked so, or the other way
+	mismatched int
+	minY, maxY int
+	// byY counts the columns by their lowest block in bands of 16 blocks
+	byY [16]int
+}
+
+func inspectLowMap(m *lowmap.LowMap) *lowMapStats {
+	s := &lowMapStats{chunks: m.Len(), minY: lowmap.Empty}
+	for i, pos := range m.Positions {
+		if i == 0 || pos.X < s.minX {
+			s.minX = pos.X
+		}
+		if i == 0 || pos.Z < s.minZ {
+			s.minZ = pos.Z
+		}
+		if i == 0 || pos.X > s.maxX {
+			s.maxX = pos.X
+		}
+		if i == 0 || pos.Z > s.maxZ {
+			s.maxZ = pos.Z
+		}
+
+		c := m.Chunk(pos.X, pos.Z)
+		for z := 0; z < 16; z++ {
+			for x := 0; x < 16; x++ {
+				s.columns++
+				y, ok := c.LowY(x, z)
+				if ok == c.IsEmpty(x, z) {
+					s.mismatched++
+				}
+				if !ok {
+					s.emptyColumns++
+					continue
+				}
+				if y < s.minY {
+					s.minY = y
+				}
+				if y > s.maxY {
+					s.maxY = y
+				}
+				s.byY[y>>4]++
+			}
+		}
+	}
+	if s.minY > s.maxY {
+		s.minY = 0
+	}
+	return s
+}
+
+func (s *lowMapStats) print() {
+	fmt.Println("chunks:", s.chunks)
+	if s.chunks > 0 {
+		fmt.Printf("bounds: chunks %d,%d to %d,%d\n", s.minX, s.minZ, s.maxX, s.maxZ)
+	}
+	fmt.Println("columns:", s.columns)
+	fmt.Println("empty columns:", s.emptyColumns)
+	fmt.Println("mismatched empty bits:", s.mismatched)
+	fmt.Println("lowest block y:", s.minY, "to", s.maxY)
+	for band, count := range s.byY {
+		if count > 0 {
+			fmt.Printf("  y %3d-%3d: %d\n", band<<4, band<<4+15, count)
+		}
+	}
+}
+
+// renderLowMap draws the lowest block of every column as a gray level, white
+// for empty columns. Missing chunks are transparent.
+func renderLowMap(m *lowmap.LowMap) (*image.NRGBA, error) {
+	s := inspectLowMap(m)
+	if s.chunks == 0 {
+		return nil, fmt.Errorf("no chunks to render")
+	}
+	width := (s.maxX - s.minX + 1) << 4
+	height := (s.maxZ - s.minZ + 1) << 4
+	if int64(width)*int64(height) > maxRenderPixels {
+		return nil, fmt.Errorf("map of %dx%d pixels too large", width, height)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for _, pos := range m.Positions {
+		c := m.Chunk(pos.X, pos.Z)
+		for z := 0; z < 16; z++ {
+			for x := 0; x < 16; x++ {
+				y, _ := c.LowY(x, z)
+				img.SetNRGBA((pos.X-s.minX)<<4+x, (pos.Z-s.minZ)<<4+z, color.NRGBA{uint8(y), uint8(y), uint8(y), 255})
+			}
+		}
+	}
+	return img, nil
+}
+
+// inspectLowMapCommand prints the stats of a lowmap.bin file and renders it.
+func inspectLowMapCommand(args []string) {
+	flags := flag.NewFlagSet("inspect-lowmap", flag.ExitOnError)
+	output := flags.String("png", "", "Render the low map as a grayscale PNG image to the `file`")
+	flags.Usage = func() {
+		w := flags.Output()
+		base := filepath.Base(os.Args[0])
+		fmt.Fprintln(w, "Usage:")
+		fmt.Fprintln(w, " ", base, "inspect-lowmap [options] lowmap.bin|dimension")
+		fmt.Fprintln(w, "Examples:")
+		fmt.Fprintln(w, " ", base, "inspect-lowmap world_opt/lowmap.bin")
+		fmt.Fprintln(w, " ", base, "inspect-lowmap -png nether.png world_opt/DIM-1")
+		fmt.Fprintln(w, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return
+	}
+
+	path := strings.Join(flags.Args(), " ")
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "lowmap.bin")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	m, err := lowmap.Read(f)
+	f.Close()
+	if err != nil {
+		log.Fatalln(path, err)
+	}
+
+	fmt.Println("version:", m.Version)
+	if m.Version > 1 {
+		fmt.Println("dimension:", m.Dimension)
+		fmt.Println("compression:", m.Compression)
+	}
+	inspectLowMap(m).print()
+
+	if *output != "" {
+		img, err := renderLowMap(m)
+		if err != nil {
+			log.Fatalln(path, err)
+		}
+		out, err := os.Create(*output)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := png.Encode(out, img); err != nil {
+			out.Close()
+			log.Fatalln(err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// journal records an overwrite in progress next to the overwritten world, so
+// a save interrupted by a crash is rolled back on the next run.
+//
+// Folders are changed in place: the original files are moved to a backup
+// folder next to the world before they are replaced or removed. Archives are
+// written to a temporary file next to the original and renamed over it.
+type journal struct {
+	path string
+	// Target is the overwritten world folder or archive
+	Target string `json:"target"`
+	// Backup is the folder with the original files of a world folder
+	Backup string `json:"backup,omitempty"`
+	// Temp is the new archive before it replaces the original
+	Temp string `json:"temp,omitempty"`
+	// Committed is set once all changes are applied
+	Committed bool           `json:"committed"`
+	Written   []journalEntry `json:"written,omitempty"`
+	Removed   []string       `json:"removed,omitempty"`
+}
+
+type journalEntry struct {
+	Path    string `json:"path"`
+	Existed bool   `json:"existed"`
+	Dir     bool   `json:"dir"`
+}
+
+// journalPath returns the path of the journal of the world folder or archive.
+func journalPath(target string) string {
+	target = filepath.Clean(target)
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".trim-journal")
+}
+
+// tempPath returns the path of the file written before it replaces the file.
+func tempPath(file string) string {
+	return filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".trim-tmp")
+}
+
+func newJournal(target string) *journal {
+	// Absolute paths let a run from another folder recover the save
+	if abs, err := filepath.Abs(target); err == nil {
+		target = abs
+	}
+	return &journal{path: journalPath(target), Target: filepath.Clean(target)}
+}
+
+// save writes the journal to the disk before any change it describes.
+func (j *journal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := tempPath(j.path)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("%s journal write: %w", j.Target, err)
+	}
+	return nil
+}
+
+// backup returns the path of the original of the file in the backup folder.
+func (j *journal) backup(path string) string {
+	return filepath.Join(j.Backup, path)
+}
+
+// commit marks the changes as applied and removes the backup and the journal.
+func (j *journal) commit() error {
+	j.Committed = true
+	if err := j.save(); err != nil {
+		return err
+	}
+	return j.cleanup()
+}
+
+func (j *journal) cleanup() error {
+	if j.Backup != "" {
+		if err := os.RemoveAll(j.Backup); err != nil {
+			return err
+		}
+	}
+	if j.Temp != "" {
+		if err := os.Remove(j.Temp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Remove(j.path)
+}
+
+// rollback restores the original files of the world.
+func (j *journal) rollback() error {
+	for i := len(j.Written) - 1; i >= 0; i-- {
+		e := j.Written[i]
+		dest := filepath.Join(j.Target, e.Path)
+		if err := os.Remove(tempPath(dest)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if e.Dir {
+			if !e.Existed {
+				if err := os.RemoveAll(dest); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !e.Existed {
+			if err := os.Remove(dest); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		} else if _, err := os.Lstat(j.backup(e.Path)); err == nil {
+			if err := os.Rename(j.backup(e.Path), dest); err != nil {
+				return err
+			}
+		}
+	}
+	for _, path := range j.Removed {
+		if _, err := os.Lstat(j.backup(path)); err != nil {
+			continue
+		}
+		dest := filepath.Join(j.Target, path)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(j.backup(path), dest); err != nil {
+			return err
+		}
+	}
+	return j.cleanup()
+}
+
+// recoverJournal rolls back or completes a save of the world folder or
+// archive interrupted by a previous run.
+func recoverJournal(target string) error {
+	path := journalPath(target)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	j := &journal{path: path}
+	if err := json.Unmarshal(data, j); err != nil {
+		return fmt.Errorf("%s journal read: %w", target, err)
+	}
+	if j.Committed {
+		log.Println("Finish interrupted save of", j.Target)
+		return j.cleanup()
+	}
+	log.Println("Roll back interrupted save of", j.Target)
+	if err := j.rollback(); err != nil {
+		return fmt.Errorf("%s rollback: %w", j.Target, err)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// writeWorld creates the files of a world folder.
+func writeWorld(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// osTree returns the snapshot of the folder on disk.
+func osTree(t *testing.T, dir string) map[string]fsEntry {
+	t.Helper()
+	return snapshot(t, afero.NewBasePathFs(afero.NewOsFs(), dir), "")
+}
+
+// checkLeftovers fails if the folder has other files than the names.
+func checkLeftovers(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	list, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range list {
+		got = append(got, entry.Name())
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("files next to the world %v, want %v", got, names)
+	}
+}
+
+// newChangedWorld returns a world folder opened with changes of every kind:
+// a changed file, a file replaced by a folder, a removed folder created
+// again, removed and added files and folders.
+func newChangedWorld(t *testing.T) (dir string, s *DirSource, original, changed map[string]fsEntry) {
+	t.Helper()
+	dir = filepath.Join(t.TempDir(), "world")
+	writeWorld(t, dir, map[string]string{
+		"level.dat":        "level",
+		"region/r.0.0.mca": "region",
+		"x":                "file replaced by a folder",
+		"d/f1":             "removed with its folder",
+		"d/sub/f2":         "removed with its folder",
+		"gone":             "removed",
+	})
+	original = osTree(t, dir)
+
+	s = NewDirSource(dir)
+	t.Cleanup(func() { s.Close() })
+	fs := s.Fs()
+	for _, err := range []error{
+		afero.WriteFile(fs, "region/r.0.0.mca", []byte("changed"), 0644),
+		fs.RemoveAll("x"),
+		fs.Mkdir("x", 0755),
+		afero.WriteFile(fs, "x/y", []byte("in the new folder"), 0644),
+		fs.RemoveAll("d"),
+		fs.Mkdir("d", 0755),
+		afero.WriteFile(fs, "d/new", []byte("in the folder created again"), 0644),
+		fs.Remove("gone"),
+		afero.WriteFile(fs, "added", []byte("added"), 0644),
+		fs.MkdirAll("newdir/sub", 0755),
+		afero.WriteFile(fs, "newdir/sub/f", []byte("added"), 0644),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	changed = snapshot(t, fs, "")
+	return
+}
+
+func TestSaveInPlace(t *testing.T) {
+	defer func(o bool) { *overwrite = o }(*overwrite)
+	*overwrite = true
+
+	dir, s, _, changed := newChangedWorld(t)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := osTree(t, dir); !reflect.DeepEqual(got, changed) {
+		t.Errorf("saved world:\n got %v\nwant %v", got, changed)
+	}
+	checkLeftovers(t, filepath.Dir(dir), "world")
+}
+
+func TestSaveInPlace_RecoverCrash(t *testing.T) {
+	_, s, _, _ := newChangedWorld(t)
+	j, err := s.journal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := len(j.Written)
+
+	// A crash after the first n written files, n = steps being a crash
+	// before the commit
+	for n := 0; n <= steps; n++ {
+		dir, s, original, _ := newChangedWorld(t)
+		j, err := s.journal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		partial := *j
+		partial.Written = j.Written[:n]
+		if err := s.apply(&partial); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := recoverJournal(dir); err != nil {
+			t.Fatal(err)
+		}
+		if got := osTree(t, dir); !reflect.DeepEqual(got, original) {
+			t.Errorf("crash after %d of %d files, rolled back world:\n got %v\nwant %v", n, steps, got, original)
+		}
+		checkLeftovers(t, filepath.Dir(dir), "world")
+	}
+}
+
+func TestSaveInPlace_RecoverCommitted(t *testing.T) {
+	dir, s, _, changed := newChangedWorld(t)
+	j, err := s.journal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.apply(j); err != nil {
+		t.Fatal(err)
+	}
+	// A crash after the journal is committed, before its cleanup
+	j.Committed = true
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recoverJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := osTree(t, dir); !reflect.DeepEqual(got, changed) {
+		t.Errorf("finished world:\n got %v\nwant %v", got, changed)
+	}
+	checkLeftovers(t, filepath.Dir(dir), "world")
+}
+
+// writeArchive writes a zip or tar archive with the file level.dat.
+func writeArchive(t *testing.T, path, level string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if filepath.Ext(path) == ".zip" {
+		zw := zip.NewWriter(f)
+		w, err := zw.Create("level.dat")
+		if err == nil {
+			_, err = io.WriteString(w, level)
+		}
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	tw := tar.NewWriter(f)
+	err = tw.WriteHeader(&tar.Header{Name: "level.dat", Mode: 0644, Size: int64(len(level)), Typeflag: tar.TypeReg})
+	if err == nil {
+		_, err = io.WriteString(tw, level)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLevelDat returns the level.dat of the archive, after recovery.
+func readLevelDat(t *testing.T, path string) string {
+	t.Helper()
+	source := openSource(path)
+	defer source.Close()
+	data, err := afero.ReadFile(source.Fs(), "level.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestArchiveJournal_Recover(t *testing.T) {
+	for _, ext := range []string{".zip", ".tar"} {
+		// A crash while the new archive is written
+		path := filepath.Join(t.TempDir(), "world"+ext)
+		writeArchive(t, path, "original")
+		j := newJournal(path)
+		j.Temp = tempPath(j.Target)
+		if err := j.save(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(j.Temp, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := readLevelDat(t, path); got != "original" {
+			t.Errorf("%s: level.dat %q after a crash while writing", ext, got)
+		}
+		checkLeftovers(t, filepath.Dir(path), "world"+ext)
+
+		// A crash after the new archive replaced the original
+		path = filepath.Join(t.TempDir(), "world"+ext)
+		writeArchive(t, path, "optimized")
+		j = newJournal(path)
+		j.Temp = tempPath(j.Target)
+		j.Committed = true
+		if err := j.save(); err != nil {
+			t.Fatal(err)
+		}
+		if got := readLevelDat(t, path); got != "optimized" {
+			t.Errorf("%s: level.dat %q after a crash once committed", ext, got)
+		}
+		checkLeftovers(t, filepath.Dir(path), "world"+ext)
+	}
+}
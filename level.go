@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Tnze/go-mc/nbt"
+	"github.com/klauspost/compress/gzip"
+	"github.com/spf13/afero"
+)
+
+// Level holds the fields of level.dat used by the optimizer.
+type Level struct {
+	Data struct {
+		SpawnX int32
+		SpawnY int32
+		SpawnZ int32
+	}
+}
+
+// SpawnChunk returns the position of the chunk with the spawn point.
+func (l *Level) SpawnChunk() ChunkPos {
+	return ChunkPos{int(l.Data.SpawnX) >> 4, int(l.Data.SpawnZ) >> 4}
+}
+
+func readLevel(fs afero.Fs, dir string) (*Level, error) {
+	path := filepath.Join(dir, "level.dat")
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s read: %w", path, err)
+	}
+	level := new(Level)
+	if _, err := nbt.NewDecoder(r).Decode(level); err != nil {
+		return nil, fmt.Errorf("%s decode: %w", path, err)
+	}
+	return level, nil
+}
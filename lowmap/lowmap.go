@@ -0,0 +1,222 @@
+// Package lowmap reads and writes the lowmap.bin files with the lowest block
+// of every column of a dimension.
+//
+// A chunk has the Y of the lowest block of each of its 256 columns indexed by
+// z<<4|x, 255 for columns without blocks, and a 32 bytes bit set marking
+// these empty columns. Numbers are big endian.
+//
+// A version 1 file starts with the number of chunks and their positions,
+// followed by the columns of every chunk in the same order.
+//
+// A version 2 file starts with a header: the magic "LOWM", the version, the
+// dimension ID, the compression, a reserved byte, the number of chunks and
+// the CRC-32 of the uncompressed entries. Every entry has the position of the
+// chunk, flags and the columns, a single Y if all columns are the same or
+// nothing if all columns are empty. The entries may be compressed with
+// deflate or zstd.
+package lowmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// ChunkSize is the size of the columns of a chunk
+	ChunkSize = 256 + 32
+	// Empty is the Y of columns without blocks
+	Empty = 255
+)
+
+// Dimension IDs
+const (
+	Overworld = 0
+	Nether    = -1
+	End       = 1
+)
+
+type Pos struct {
+	X int
+	Z int
+}
+
+// Chunk holds the columns of a chunk.
+type Chunk []byte
+
+// LowY returns the Y of the lowest block of the column at the chunk relative
+// position, ok is false if the column is empty.
+func (c Chunk) LowY(x, z int) (y int, ok bool) {
+	y = int(c[(z&15)<<4|(x&15)])
+	return y, y != Empty
+}
+
+// IsEmpty tests the bit marking the column at the chunk relative position as
+// empty.
+func (c Chunk) IsEmpty(x, z int) bool {
+	idx := (z&15)<<4 | (x & 15)
+	return c[256+idx/8]&(0x80>>uint(idx%8)) != 0
+}
+
+// uniform returns the Y shared by all columns, ok is false if they differ.
+func (c Chunk) uniform() (y byte, ok bool) {
+	for _, v := range c[1:256] {
+		if v != c[0] {
+			return 0, false
+		}
+	}
+	return c[0], true
+}
+
+// uniformChunk returns the columns of a chunk with all columns at the Y.
+func uniformChunk(y byte) Chunk {
+	c := make(Chunk, ChunkSize)
+	for i := 0; i < 256; i++ {
+		c[i] = y
+	}
+	if y == Empty {
+		for i := 256; i < ChunkSize; i++ {
+			c[i] = 0xFF
+		}
+	}
+	return c
+}
+
+// LowMap is a decoded lowmap.bin file.
+type LowMap struct {
+	// Version of the file format, 1 or 2
+	Version int
+	// Dimension ID, always Overworld in version 1 files
+	Dimension int
+	// Compression of version 2 files
+	Compression Compression
+	// Positions of the chunks in the order of the file
+	Positions []Pos
+	chunks    map[Pos]Chunk
+}
+
+// New returns an empty low map of the dimension.
+func New(dimension int) *LowMap {
+	return &LowMap{Version: 2, Dimension: dimension, chunks: make(map[Pos]Chunk)}
+}
+
+// Read decodes a lowmap.bin file.
+func Read(r io.Reader) (*LowMap, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes the content of a lowmap.bin file of any version.
+func Parse(data []byte) (*LowMap, error) {
+	if len(data) >= len(magic) && string(data[:len(magic)]) == magic {
+		return parseV2(data)
+	}
+	return parseV1(data)
+}
+
+func parseV1(data []byte) (*LowMap, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("lowmap: file of %d bytes too short", len(data))
+	}
+	count := int(binary.BigEndian.Uint32(data))
+	if int64(len(data)) != 4+int64(count)*(8+ChunkSize) {
+		return nil, fmt.Errorf("lowmap: file of %d bytes doesn't match %d chunks", len(data), count)
+	}
+
+	m := New(Overworld)
+	m.Version = 1
+	columns := data[4+count*8:]
+	for i := 0; i < count; i++ {
+		pos := Pos{
+			X: int(int32(binary.BigEndian.Uint32(data[4+i*8:]))),
+			Z: int(int32(binary.BigEndian.Uint32(data[8+i*8:]))),
+		}
+		if err := m.add(pos, Chunk(columns[i*ChunkSize:(i+1)*ChunkSize])); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *LowMap) add(pos Pos, c Chunk) error {
+	if _, ok := m.chunks[pos]; ok {
+		return fmt.Errorf("lowmap: duplicate chunk %d,%d", pos.X, pos.Z)
+	}
+	m.Positions = append(m.Positions, pos)
+	m.chunks[pos] = c
+	return nil
+}
+
+// Set adds or replaces the columns of the chunk.
+func (m *LowMap) Set(x, z int, c Chunk) error {
+	if len(c) != ChunkSize {
+		return fmt.Errorf("lowmap: chunk %d,%d of %d bytes, expected %d", x, z, len(c), ChunkSize)
+	}
+	pos := Pos{x, z}
+	if _, ok := m.chunks[pos]; !ok {
+		m.Positions = append(m.Positions, pos)
+	}
+	m.chunks[pos] = c
+	return nil
+}
+
+// Sort orders the chunks by Z, then by X.
+func (m *LowMap) Sort() {
+	sort.Slice(m.Positions, func(i, j int) bool {
+		if m.Positions[i].Z == m.Positions[j].Z {
+			return m.Positions[i].X < m.Positions[j].X
+		}
+		return m.Positions[i].Z < m.Positions[j].Z
+	})
+}
+
+// Len returns the number of chunks.
+func (m *LowMap) Len() int {
+	return len(m.Positions)
+}
+
+// Chunk returns the columns of the chunk, nil if the chunk is missing.
+func (m *LowMap) Chunk(x, z int) Chunk {
+	return m.chunks[Pos{x, z}]
+}
+
+// LowY returns the Y of the lowest block of the column at the block position,
+// ok is false if the column is empty or its chunk is missing.
+func (m *LowMap) LowY(x, z int) (y int, ok bool) {
+	c := m.Chunk(x>>4, z>>4)
+	if c == nil {
+		return 0, false
+	}
+	return c.LowY(x, z)
+}
+
+// Encode writes the low map in its version and compression.
+func (m *LowMap) Encode() ([]byte, error) {
+	switch m.Version {
+	case 1:
+		if m.Compression != None {
+			return nil, fmt.Errorf("lowmap: version 1 can't be compressed")
+		}
+		return m.encodeV1(), nil
+	case 2:
+		return m.encodeV2()
+	}
+	return nil, fmt.Errorf("lowmap: unknown version %d", m.Version)
+}
+
+func (m *LowMap) encodeV1() []byte {
+	buf := make([]byte, 0, 4+len(m.Positions)*(8+ChunkSize))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Positions)))
+	for _, pos := range m.Positions {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(pos.X))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(pos.Z))
+	}
+	for _, pos := range m.Positions {
+		buf = append(buf, m.chunks[pos]...)
+	}
+	return buf
+}
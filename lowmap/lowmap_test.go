@@ -0,0 +1,166 @@
+package lowmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// testChunk returns columns at Y 64 with the first column at Y 5 and the
+// second one empty.
+func testChunk() Chunk {
+	c := uniformChunk(64)
+	c[0] = 5
+	c[1] = Empty
+	c[256] = 0x40
+	return c
+}
+
+func checkColumns(t *testing.T, c Chunk) {
+	t.Helper()
+	if c == nil {
+		t.Fatal("chunk missing")
+	}
+	for _, tc := range []struct {
+		x, y  int
+		ok    bool
+		empty bool
+	}{
+		{0, 5, true, false},
+		{1, Empty, false, true},
+		{2, 64, true, false},
+	} {
+		if y, ok := c.LowY(tc.x, 0); y != tc.y || ok != tc.ok {
+			t.Errorf("column %d: LowY %d, %v, want %d, %v", tc.x, y, ok, tc.y, tc.ok)
+		}
+		if empty := c.IsEmpty(tc.x, 0); empty != tc.empty {
+			t.Errorf("column %d: IsEmpty %v, want %v", tc.x, empty, tc.empty)
+		}
+	}
+}
+
+func TestParseV1(t *testing.T) {
+	var data []byte
+	data = binary.BigEndian.AppendUint32(data, 1)
+	data = binary.BigEndian.AppendUint32(data, 2)
+	data = binary.BigEndian.AppendUint32(data, uint32(0xFFFFFFFD)) // -3
+	data = append(data, testChunk()...)
+
+	m, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != 1 || m.Dimension != Overworld || m.Len() != 1 {
+		t.Fatalf("version %d, dimension %d, %d chunks", m.Version, m.Dimension, m.Len())
+	}
+	checkColumns(t, m.Chunk(2, -3))
+	if y, ok := m.LowY(2<<4, -3<<4); y != 5 || !ok {
+		t.Errorf("LowY of the block %d,%d is %d, %v", 2<<4, -3<<4, y, ok)
+	}
+	if _, ok := m.LowY(0, 0); ok {
+		t.Error("LowY of a missing chunk")
+	}
+}
+
+func TestParseV2(t *testing.T) {
+	var entries []byte
+	entries = binary.BigEndian.AppendUint32(entries, 0)
+	entries = binary.BigEndian.AppendUint32(entries, 0)
+	entries = append(entries, 0)
+	entries = append(entries, testChunk()...)
+	entries = binary.BigEndian.AppendUint32(entries, 1)
+	entries = binary.BigEndian.AppendUint32(entries, 0)
+	entries = append(entries, FlagUniform, 30)
+	entries = binary.BigEndian.AppendUint32(entries, 2)
+	entries = binary.BigEndian.AppendUint32(entries, 0)
+	entries = append(entries, FlagEmpty)
+
+	data := []byte("LOWM")
+	data = append(data, 2, 0xFF, byte(None), 0)
+	data = binary.BigEndian.AppendUint32(data, 3)
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(entries))
+	data = append(data, entries...)
+
+	m, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != 2 || m.Dimension != Nether || m.Len() != 3 {
+		t.Fatalf("version %d, dimension %d, %d chunks", m.Version, m.Dimension, m.Len())
+	}
+	checkColumns(t, m.Chunk(0, 0))
+	if y, ok := m.Chunk(1, 0).LowY(7, 7); y != 30 || !ok {
+		t.Errorf("uniform chunk: LowY %d, %v", y, ok)
+	}
+	if m.Chunk(1, 0).IsEmpty(7, 7) {
+		t.Error("uniform chunk: column empty")
+	}
+	empty := m.Chunk(2, 0)
+	if _, ok := empty.LowY(7, 7); ok || !empty.IsEmpty(7, 7) {
+		t.Error("empty chunk: column not empty")
+	}
+
+	data[len(data)-1] ^= 1
+	if _, err := Parse(data); err == nil {
+		t.Error("corrupt entries parsed")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, compression := range []Compression{None, Deflate, Zstd} {
+		for _, count := range []int{0, 1, 3, 5000} {
+			m := New(End)
+			m.Compression = compression
+			for i := 0; i < count; i++ {
+				var c Chunk
+				switch i % 3 {
+				case 0:
+					c = testChunk()
+					c[2] = byte(i)
+				case 1:
+					c = uniformChunk(byte(i))
+				default:
+					c = uniformChunk(Empty)
+				}
+				if err := m.Set(i%71-35, i/71, c); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := m.Encode()
+			if err != nil {
+				t.Fatalf("%v, %d chunks: %v", compression, count, err)
+			}
+			read, err := Read(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%v, %d chunks: %v", compression, count, err)
+			}
+			if read.Compression != compression || read.Dimension != End || read.Len() != count {
+				t.Fatalf("%v, %d chunks: read %v, dimension %d, %d chunks", compression, count, read.Compression, read.Dimension, read.Len())
+			}
+			for i, pos := range m.Positions {
+				if read.Positions[i] != pos || !bytes.Equal(read.Chunk(pos.X, pos.Z), m.Chunk(pos.X, pos.Z)) {
+					t.Fatalf("%v, %d chunks: chunk %d,%d differs", compression, count, pos.X, pos.Z)
+				}
+			}
+		}
+	}
+
+	m := New(Overworld)
+	m.Version = 1
+	if err := m.Set(4, 5, testChunk()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Version != 1 {
+		t.Errorf("version %d", read.Version)
+	}
+	checkColumns(t, read.Chunk(4, 5))
+}
@@ -0,0 +1,196 @@
+package lowmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zstd"
+)
+
+const magic = "LOWM"
+
+// headerSize is the size of the version 2 header
+const headerSize = 4 + 4 + 4 + 4
+
+// zstdMinMemory is the memory allowed to the zstd decoder of small files,
+// the window of the SpeedBestCompression level must fit in it
+const zstdMinMemory = 8 << 20
+
+// Entry flags of version 2 files
+const (
+	// FlagEmpty marks chunks with all columns empty, stored without columns
+	FlagEmpty = 1 << iota
+	// FlagUniform marks chunks with all columns at the same Y, stored as a
+	// single byte
+	FlagUniform
+)
+
+type Compression byte
+
+const (
+	None Compression = iota
+	Deflate
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case None:
+		return "none"
+	case Deflate:
+		return "deflate"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+// ParseCompression returns the compression by its name.
+func ParseCompression(name string) (Compression, error) {
+	for _, c := range []Compression{None, Deflate, Zstd} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return None, fmt.Errorf("lowmap: unknown compression %q", name)
+}
+
+func (m *LowMap) encodeV2() ([]byte, error) {
+	entries := make([]byte, 0, len(m.Positions)*(9+ChunkSize))
+	for _, pos := range m.Positions {
+		c := m.chunks[pos]
+		entries = binary.BigEndian.AppendUint32(entries, uint32(pos.X))
+		entries = binary.BigEndian.AppendUint32(entries, uint32(pos.Z))
+		if y, ok := c.uniform(); ok && bytes.Equal(c, uniformChunk(y)) {
+			if y == Empty {
+				entries = append(entries, FlagEmpty)
+			} else {
+				entries = append(entries, FlagUniform, y)
+			}
+		} else {
+			entries = append(entries, 0)
+			entries = append(entries, c...)
+		}
+	}
+
+	buf := make([]byte, 0, headerSize+len(entries))
+	buf = append(buf, magic...)
+	buf = append(buf, 2, byte(int8(m.Dimension)), byte(m.Compression), 0)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Positions)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(entries))
+
+	switch m.Compression {
+	case None:
+		return append(buf, entries...), nil
+	case Deflate:
+		out := bytes.NewBuffer(buf)
+		w, err := flate.NewWriter(out, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(entries); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	case Zstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(entries, buf), nil
+	}
+	return nil, fmt.Errorf("lowmap: unknown compression %v", m.Compression)
+}
+
+func parseV2(data []byte) (*LowMap, error) {
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("lowmap: header of %d bytes too short", len(data))
+	}
+	if version := data[4]; version != 2 {
+		return nil, fmt.Errorf("lowmap: unknown version %d", version)
+	}
+	m := New(int(int8(data[5])))
+	m.Compression = Compression(data[6])
+	count := int(binary.BigEndian.Uint32(data[8:]))
+	checksum := binary.BigEndian.Uint32(data[12:])
+
+	// Entries are never larger than the full columns
+	maxSize := int64(count) * (9 + ChunkSize)
+	var entries []byte
+	var err error
+	switch m.Compression {
+	case None:
+		entries = data[headerSize:]
+	case Deflate:
+		r := flate.NewReader(bytes.NewReader(data[headerSize:]))
+		entries, err = io.ReadAll(io.LimitReader(r, maxSize+1))
+		r.Close()
+	case Zstd:
+		memory := uint64(maxSize) + 1
+		if memory < zstdMinMemory {
+			memory = zstdMinMemory
+		}
+		var dec *zstd.Decoder
+		dec, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(memory))
+		if err == nil {
+			entries, err = dec.DecodeAll(data[headerSize:], nil)
+			dec.Close()
+		}
+	default:
+		return nil, fmt.Errorf("lowmap: unknown compression %v", m.Compression)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lowmap: %v entries: %w", m.Compression, err)
+	}
+	if int64(len(entries)) > maxSize {
+		return nil, fmt.Errorf("lowmap: entries of %d bytes too large for %d chunks", len(entries), count)
+	}
+	if crc32.ChecksumIEEE(entries) != checksum {
+		return nil, fmt.Errorf("lowmap: checksum mismatch")
+	}
+
+	for i := 0; i < count; i++ {
+		if len(entries) < 9 {
+			return nil, fmt.Errorf("lowmap: entry %d truncated", i)
+		}
+		pos := Pos{
+			X: int(int32(binary.BigEndian.Uint32(entries))),
+			Z: int(int32(binary.BigEndian.Uint32(entries[4:]))),
+		}
+		flags := entries[8]
+		entries = entries[9:]
+
+		var c Chunk
+		switch {
+		case flags&FlagEmpty != 0:
+			c = uniformChunk(Empty)
+		case flags&FlagUniform != 0:
+			if len(entries) < 1 {
+				return nil, fmt.Errorf("lowmap: entry %d truncated", i)
+			}
+			c = uniformChunk(entries[0])
+			entries = entries[1:]
+		default:
+			if len(entries) < ChunkSize {
+				return nil, fmt.Errorf("lowmap: entry %d truncated", i)
+			}
+			c = Chunk(entries[:ChunkSize])
+			entries = entries[ChunkSize:]
+		}
+		if err := m.add(pos, c); err != nil {
+			return nil, err
+		}
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("lowmap: %d bytes after the entries", len(entries))
+	}
+	return m, nil
+}
@@ -5,32 +5,90 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
 
+	"mc-world-trimmer/chunk"
+	"mc-world-trimmer/lowmap"
+
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/afero"
 )
 
 var overwrite = flag.Bool("o", false, "Overwrite original world")
 var suffix = flag.String("s", "_opt", "Suffix for optimized worlds")
+var hardLink = flag.Bool("link", false, "Hard link unchanged files of optimized world folders, they share later changes with the original")
 var dryRun = flag.Bool("dry", false, "Dry run (no changes on disk)")
 var verbose = flag.Bool("v", false, "Verbose logging")
 var recursive = flag.Bool("r", false, "Recursive search for worlds")
 var heightMap = flag.Bool("hm", false, "Recalculate height maps")
+var heightMapCheck = flag.Bool("hm-check", false, "Report 1.8 chunks with height maps differing from the recalculated ones")
 var lowMap = flag.Bool("lm", false, "Compute low maps")
+var lowMapV1 = flag.Bool("lm-v1", false, "Write low maps in the version 1 format without header")
+var lowMapCompress = flag.String("lm-compress", "none", "Compression of version 2 low maps, none, deflate or zstd")
+var light = flag.Bool("light", false, "Recalculate sky and block light of 1.8 chunks")
+var noLight = flag.Bool("nolight", false, "Strip sky and block light of 1.8 chunks, the server must relight them on load (vanilla and Spigot crash)")
+var memLimit = flag.String("mem", "1GB", "Memory for changed files of a world, the rest is kept in a temporary folder next to it, 0 for no limit")
+var jobs = flag.Int("j", runtime.NumCPU(), "Number of region files processed in parallel")
+var inhabitedTime = flag.Int64("it", 0, "Remove chunks inhabited for less ticks")
+var spawnRadius = flag.Int("spawn", 8, "Radius in chunks around the overworld spawn kept by -it")
+var keepMargin = flag.Int("margin", 2, "Chunks around the kept ones kept by -it")
+var cropBlocks = flag.String("crop", "", "Remove chunks outside the box of blocks `x1,z1,x2,z2`")
+var cropChunks = flag.String("crop-chunks", "", "Remove chunks outside the box of chunks `x1,z1,x2,z2`")
+var cropRadius = flag.Int("crop-radius", 0, "Remove overworld chunks farther from the spawn than the radius in blocks")
+var maskFile = flag.String("mask", "", "Keep only the chunks listed in the mask `file`")
+var maskDelete = flag.Bool("mask-delete", false, "Remove the chunks listed in the mask instead")
+var worldGuard = flag.String("wg", "", "Keep only the chunks of WorldGuard regions from the regions.yml `file` of the overworld or plugins/WorldGuard/worlds folder")
+var worldGuardPadding = flag.Int("wg-padding", 2, "Chunks around WorldGuard regions kept by -wg")
+var tileEntities = flag.Bool("te", false, "Remove tile entities of 1.8 chunks not matching their blocks")
+var remapFile = flag.String("remap", "", "Substitute blocks of 1.8 chunks by the rules \"id[:data] -> id[:data]\" from the `file`")
+var entityRules = flag.String("entities", "", "Remove entities of 1.8 chunks by the rules from the JSON `file`, or \"default\"")
+var reportFile = flag.String("report", "", "Write the JSON report of optimized worlds to the `file`")
 
 var foundAny = false
+var reports []*WorldReport
+
+// Options parsed from flags
+var crop *CropArea
+var mask *ChunkMask
+var rules *chunk.EntityRules
+var remap *chunk.BlockRemap
+var lowMapVersion = 2
+var lowMapCompression lowmap.Compression
+var memBudget uint64
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "stats":
+			statsCommand(os.Args[2:])
+			return
+		case "render":
+			renderCommand(os.Args[2:])
+			return
+		case "inspect-lowmap":
+			inspectLowMapCommand(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
 		base := filepath.Base(os.Args[0])
 		fmt.Fprintln(w, "Usage:")
 		fmt.Fprintln(w, " ", base, "[options] path")
+		fmt.Fprintln(w, " ", base, "stats [options] path")
+		fmt.Fprintln(w, " ", base, "render [options] path")
+		fmt.Fprintln(w, " ", base, "inspect-lowmap [options] lowmap.bin|dimension")
 		fmt.Fprintln(w, "Examples:")
 		fmt.Fprintln(w, " ", base, "-r -dry .minecraft/saves")
 		fmt.Fprintln(w, " ", base, "-r -o .")
 		fmt.Fprintln(w, " ", base, "-o world.zip")
+		fmt.Fprintln(w, " ", base, "-o world.tar.zst")
+		fmt.Fprintln(w, " ", base, "-it 1200 -spawn 16 world")
 		fmt.Fprintln(w, "Options:")
 		flag.PrintDefaults()
 	}
@@ -41,13 +99,48 @@ func main() {
 		return
 	}
 
-	path := strings.Join(flag.Args(), " ")
-	if strings.HasSuffix(path, ".zip") {
-		process(NewZipSource(path), true)
-		return
+	if *light && *noLight {
+		log.Fatalln("-light and -nolight can't be used together")
+	}
+
+	var err error
+	if lowMapCompression, err = lowmap.ParseCompression(*lowMapCompress); err != nil {
+		log.Fatalln(err)
+	}
+	if *lowMapV1 {
+		if lowMapCompression != lowmap.None {
+			log.Fatalln("-lm-v1 and -lm-compress can't be used together")
+		}
+		lowMapVersion = 1
+	}
+	if memBudget, err = humanize.ParseBytes(*memLimit); err != nil {
+		log.Fatalln("-mem:", err)
 	}
+	if crop, err = parseCrop(); err != nil {
+		log.Fatalln(err)
+	}
+	if *maskFile != "" {
+		if mask, err = LoadChunkMask(*maskFile, !*maskDelete); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *remapFile != "" {
+		if remap, err = loadBlockRemap(*remapFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *entityRules != "" {
+		if rules, err = loadEntityRules(*entityRules); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	handleInterrupt()
 
-	if *recursive {
+	path := strings.Join(flag.Args(), " ")
+	if archiveExtension(path) != "" {
+		process(openSource(path), true)
+	} else if *recursive {
 		// Find plain directories
 		abspath, err := filepath.Abs(path)
 		if err != nil {
@@ -69,53 +162,126 @@ func main() {
 				continue
 			}
 			dirsDone[fullPath] = true
-			process(NewDirSource(fullPath), false)
+			process(openSource(fullPath), false)
 		}
 
-		// Find zip files
-		zipFiles, err := findZipFiles(fs)
+		// Find zip and tar files
+		archives, err := findArchives(fs)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		for _, file := range zipFiles {
-			if strings.HasSuffix(file, *suffix+".zip") {
+		for _, file := range archives {
+			if strings.HasSuffix(file, *suffix+archiveExtension(file)) {
 				log.Println("Skip", file, "as optimized")
 				continue
 			}
-			process(NewZipSource(filepath.Join(path, file)), true)
+			process(openSource(filepath.Join(path, file)), true)
 		}
 	} else {
-		process(NewDirSource(path), false)
+		process(openSource(path), false)
 	}
 
 	if !foundAny {
 		log.Println("No worlds found in", path)
 	}
+
+	if *reportFile != "" {
+		if err := writeReport(*reportFile, reports); err != nil {
+			log.Fatalln(err)
+		}
+	}
 }
 
 func process(source Source, recursive bool) {
 	optimizer := &WorldOptimizer{
 		Source:            source,
 		ComputeHeightMaps: *heightMap,
+		CheckHeightMaps:   *heightMapCheck,
 		ComputeLowMaps:    *lowMap,
+		LowMapVersion:     lowMapVersion,
+		LowMapCompression: lowMapCompression,
+		ComputeLight:      *light,
+		StripLight:        *noLight,
+		EntityRules:       rules,
+		CleanTileEntities: *tileEntities,
+		BlockRemap:        remap,
+		Workers:           *jobs,
+		MinInhabitedTime:  *inhabitedTime,
+		SpawnRadius:       *spawnRadius,
+		KeepMargin:        *keepMargin,
+		Crop:              crop,
+		Mask:              mask,
+		WorldGuardPath:    *worldGuard,
+		WorldGuardPadding: *worldGuardPadding,
+		DryRun:            *dryRun,
 	}
 	if err := optimizer.Process(recursive); err != nil {
-		log.Fatalln(err)
+		fatal(err)
 	}
 	if optimizer.AnyWorldFound {
 		foundAny = true
 	}
+	reports = append(reports, optimizer.Reports...)
 	if !*dryRun {
 		if err := source.Save(); err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 	}
 	if err := source.Close(); err != nil {
-		log.Fatalln(err)
+		fatal(err)
+	}
+}
+
+// handleInterrupt removes spilled and extracted files when interrupted.
+func handleInterrupt() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		removeTempDirs()
+		log.Fatalln("Stopped by", sig)
+	}()
+}
+
+// openSource rolls back or completes an interrupted save of the world folder
+// or archive, then opens it to be optimized.
+func openSource(path string) Source {
+	if err := recoverJournal(path); err != nil {
+		fatal(err)
+	}
+	if source := NewArchiveSource(path); source != nil {
+		return source
 	}
+	return NewDirSource(path)
 }
 
-func findZipFiles(fs afero.Fs) ([]string, error) {
+// fatal removes spilled and extracted files before exiting with the error.
+func fatal(v ...interface{}) {
+	removeTempDirs()
+	log.Fatalln(v...)
+}
+
+func parseCrop() (*CropArea, error) {
+	switch {
+	case *cropBlocks != "":
+		x1, z1, x2, z2, err := parseBox(*cropBlocks)
+		if err != nil {
+			return nil, err
+		}
+		return CropBlocks(x1, z1, x2, z2), nil
+	case *cropChunks != "":
+		x1, z1, x2, z2, err := parseBox(*cropChunks)
+		if err != nil {
+			return nil, err
+		}
+		return CropChunks(x1, z1, x2, z2), nil
+	case *cropRadius > 0:
+		return CropSpawn(*cropRadius), nil
+	}
+	return nil, nil
+}
+
+func findArchives(fs afero.Fs) ([]string, error) {
 	var files []string
 	err := afero.Walk(fs, "", func(path string, f os.FileInfo, err error) error {
 		if err != nil {
@@ -124,7 +290,7 @@ func findZipFiles(fs afero.Fs) ([]string, error) {
 		if f.IsDir() && f.Name() == ".git" {
 			return filepath.SkipDir
 		}
-		if strings.HasSuffix(path, ".zip") {
+		if !f.IsDir() && archiveExtension(path) != "" {
 			files = append(files, path)
 		}
 		return nil
@@ -134,15 +300,24 @@ func findZipFiles(fs afero.Fs) ([]string, error) {
 
 func findWorldDirs(fs afero.Fs) ([]string, error) {
 	var files []string
+	seen := make(map[string]bool)
 	err := afero.Walk(fs, "", func(path string, f os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if f.IsDir() && f.Name() == ".git" {
+		if f.IsDir() && (f.Name() == ".git" || strings.HasSuffix(f.Name(), ".trim-backup") || strings.HasSuffix(f.Name(), ".trim-spill") || strings.HasSuffix(f.Name(), ".trim-extract")) {
 			return filepath.SkipDir
 		}
 		if filepath.Base(path) == "region" && f.IsDir() {
-			files = append(files, filepath.Dir(path))
+			dir := filepath.Dir(path)
+			// Nether and end are processed together with their world
+			if name := filepath.Base(dir); name == "DIM-1" || name == "DIM1" {
+				dir = filepath.Dir(dir)
+			}
+			if !seen[dir] {
+				seen[dir] = true
+				files = append(files, dir)
+			}
 		}
 		return nil
 	})
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ChunkMask is a set of chunks and areas of chunks read from a mask file.
+type ChunkMask struct {
+	// Keep keeps the listed chunks and removes the rest. Otherwise the listed
+	// chunks are removed.
+	Keep   bool
+	Chunks map[ChunkPos]bool
+	Areas  []*CropArea
+}
+
+// LoadChunkMask reads a mask file. JSON files have the form
+//
+//	{"chunks": [[x, z], ...], "areas": [[x1, z1, x2, z2], ...]}
+//
+// Other files list a chunk "x,z" or an area "x1,z1,x2,z2" of chunks per line.
+// Lines starting with # are comments.
+func LoadChunkMask(path string, keep bool) (*ChunkMask, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mask := &ChunkMask{Keep: keep, Chunks: make(map[ChunkPos]bool)}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = mask.parseJSON(data)
+	} else {
+		err = mask.parseText(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return mask, nil
+}
+
+func (m *ChunkMask) parseJSON(data []byte) error {
+	var file struct {
+		Chunks [][2]int `json:"chunks"`
+		Areas  [][4]int `json:"areas"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	for _, c := range file.Chunks {
+		m.Chunks[ChunkPos{c[0], c[1]}] = true
+	}
+	for _, a := range file.Areas {
+		m.Areas = append(m.Areas, CropChunks(a[0], a[1], a[2], a[3]))
+	}
+	return nil
+}
+
+func (m *ChunkMask) parseText(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.Split(text, ",")
+		v := make([]int, len(parts))
+		for i, part := range parts {
+			n, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			v[i] = n
+		}
+		switch len(v) {
+		case 2:
+			m.Chunks[ChunkPos{v[0], v[1]}] = true
+		case 4:
+			m.Areas = append(m.Areas, CropChunks(v[0], v[1], v[2], v[3]))
+		default:
+			return fmt.Errorf("line %d: expected x,z or x1,z1,x2,z2", line)
+		}
+	}
+	return scanner.Err()
+}
+
+// Contains reports whether the chunk is listed in the mask.
+func (m *ChunkMask) Contains(pos ChunkPos) bool {
+	if m.Chunks[pos] {
+		return true
+	}
+	for _, area := range m.Areas {
+		if area.containsChunk(pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keeps reports whether the chunk is kept by the mask.
+func (m *ChunkMask) Keeps(pos ChunkPos) bool {
+	return m.Contains(pos) == m.Keep
+}
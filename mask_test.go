@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeMask writes the mask file to a temporary folder.
+func writeMask(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadChunkMask(t *testing.T) {
+	wantChunks := map[ChunkPos]bool{{3, -4}: true, {0, 0}: true}
+	wantAreas := []*CropArea{{MinX: 8, MinZ: 5, MaxX: 10, MaxZ: 10}, {MinX: -2, MinZ: -2, MaxX: -1, MaxZ: -1}}
+	for _, tc := range []struct{ name, data string }{
+		{"mask.txt", "# spawn\n\n  3, -4 \n0,0\r\n\t# reversed corners\n10,10,8,5\n-1,-1,-2,-2\n"},
+		{"mask", "3,-4\n0,0\n10,10,8,5\n-1,-1,-2,-2"},
+		{"mask.JSON", `{"chunks": [[3, -4], [0, 0]], "areas": [[10, 10, 8, 5], [-1, -1, -2, -2]]}`},
+	} {
+		path := writeMask(t, tc.name, tc.data)
+		for _, keep := range []bool{true, false} {
+			mask, err := LoadChunkMask(path, keep)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if mask.Keep != keep || !reflect.DeepEqual(mask.Chunks, wantChunks) || !reflect.DeepEqual(mask.Areas, wantAreas) {
+				t.Errorf("%s: mask %v %v %v, want %v %v %v", tc.name, mask.Keep, mask.Chunks, mask.Areas, keep, wantChunks, wantAreas)
+			}
+			for _, pos := range []struct {
+				ChunkPos
+				listed bool
+			}{
+				{ChunkPos{3, -4}, true},
+				{ChunkPos{-4, 3}, false},
+				{ChunkPos{8, 5}, true},
+				{ChunkPos{9, 10}, true},
+				{ChunkPos{11, 7}, false},
+				{ChunkPos{-2, -1}, true},
+				{ChunkPos{0, -1}, false},
+			} {
+				if got := mask.Contains(pos.ChunkPos); got != pos.listed {
+					t.Errorf("%s: %v listed %v, want %v", tc.name, pos.ChunkPos, got, pos.listed)
+				}
+				if got := mask.Keeps(pos.ChunkPos); got != (pos.listed == keep) {
+					t.Errorf("%s: keep %v: %v kept %v", tc.name, keep, pos.ChunkPos, got)
+				}
+			}
+		}
+	}
+}
+
+func TestLoadChunkMask_Errors(t *testing.T) {
+	for _, tc := range []struct{ name, data, err string }{
+		{"mask.txt", "# chunk\n1\n", "line 2: expected x,z or x1,z1,x2,z2"},
+		{"mask.txt", "1,2,3", "line 1: expected x,z or x1,z1,x2,z2"},
+		{"mask.txt", "1,2\n1,2,3,4,5", "line 2: expected x,z or x1,z1,x2,z2"},
+		{"mask.txt", "0,0\n\n1,z", `line 3: strconv.Atoi: parsing "z": invalid syntax`},
+		{"mask.txt", "1,,2", `line 1: strconv.Atoi: parsing "": invalid syntax`},
+		{"mask.json", `{"chunks": [["a", 1]]}`, "cannot unmarshal"},
+		{"mask.json", `{"areas": [[1, 2, 3, 4]`, "unexpected end of JSON input"},
+	} {
+		path := writeMask(t, tc.name, tc.data)
+		_, err := LoadChunkMask(path, true)
+		if err == nil || !strings.HasPrefix(err.Error(), path+": ") || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: error %v, want %s: ...%s", tc.data, err, path, tc.err)
+		}
+	}
+
+	if _, err := LoadChunkMask(filepath.Join(t.TempDir(), "missing.txt"), true); !os.IsNotExist(err) {
+		t.Errorf("missing file: error %v", err)
+	}
+}
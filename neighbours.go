@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"mc-world-trimmer/chunk"
+
+	"github.com/Tnze/go-mc/save/region"
+	"github.com/spf13/afero"
+)
+
+type litChunk struct {
+	local ChunkPos
+	chunk *chunk.Chunk_1_8_8
+}
+
+// neighbourLoader reads the chunks of other region files as they were before
+// the optimization, so it doesn't depend on the order regions are processed.
+// Chunks removed by filters are left out.
+type neighbourLoader struct {
+	fs      afero.Fs
+	dim     *dimension
+	remap   *chunk.BlockRemap
+	files   map[ChunkPos]afero.File
+	regions map[ChunkPos]*region.Region
+	chunks  map[ChunkPos]*chunk.Chunk_1_8_8
+}
+
+func (o *WorldOptimizer) newNeighbourLoader(dim *dimension) *neighbourLoader {
+	return &neighbourLoader{
+		fs:      o.sourceFs(),
+		dim:     dim,
+		remap:   o.BlockRemap,
+		files:   make(map[ChunkPos]afero.File),
+		regions: make(map[ChunkPos]*region.Region),
+		chunks:  make(map[ChunkPos]*chunk.Chunk_1_8_8),
+	}
+}
+
+// load returns the 1.8 chunk at the absolute position, or nil if there is
+// none.
+func (l *neighbourLoader) load(pos ChunkPos) (*chunk.Chunk_1_8_8, error) {
+	if c, ok := l.chunks[pos]; ok {
+		return c, nil
+	}
+	c, err := l.read(pos)
+	if err != nil {
+		return nil, err
+	}
+	l.chunks[pos] = c
+	return c, nil
+}
+
+func (l *neighbourLoader) read(pos ChunkPos) (*chunk.Chunk_1_8_8, error) {
+	if l.dim.keep.removedBy(pos) != "" {
+		return nil, nil
+	}
+
+	rpos := ChunkPos{pos.X >> 5, pos.Z >> 5}
+	rg, ok := l.regions[rpos]
+	if !ok {
+		path := filepath.Join(l.dim.dir, "region", fmt.Sprintf("r.%d.%d.mca", rpos.X, rpos.Z))
+		if exists, err := afero.Exists(l.fs, path); err != nil {
+			return nil, err
+		} else if exists {
+			file, err := l.fs.Open(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s region file read: %w", path, err)
+			}
+			l.files[rpos] = file
+			if rg, err = region.Load(file); err != nil {
+				return nil, fmt.Errorf("%s region load: %w", path, err)
+			}
+		}
+		l.regions[rpos] = rg
+	}
+	if rg == nil {
+		return nil, nil
+	}
+
+	cx, cz := pos.X&31, pos.Z&31
+	if !rg.ExistSector(cx, cz) {
+		return nil, nil
+	}
+	sector, err := rg.ReadSector(cx, cz)
+	if err != nil {
+		return nil, fmt.Errorf("read sector %d,%d: %w", pos.X, pos.Z, err)
+	}
+	c, err := chunk.Load(sector)
+	if err != nil {
+		return nil, fmt.Errorf("read chunk %d,%d: %w", pos.X, pos.Z, err)
+	}
+	if c, ok := c.(*chunk.Chunk_1_8_8); ok {
+		if l.remap != nil {
+			c.Remap(l.remap)
+		}
+		return c, nil
+	}
+	return nil, nil
+}
+
+func (l *neighbourLoader) close() {
+	for _, file := range l.files {
+		_ = file.Close()
+	}
+}
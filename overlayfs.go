@@ -1,108 +1,320 @@
 package main
 
 import (
+	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/spf13/afero"
 )
 
+// OverlayFs is a copy-on-write file system over the source. Written files are
+// stored in the changes file system. Removed files and folders of the source
+// are hidden by whiteouts, which also hide everything below them, so a folder
+// created again after removal starts empty.
 type OverlayFs struct {
-	source          afero.Fs
-	changes         afero.Fs
-	overlay         afero.Fs
-	deletedFiles    map[string]bool
-	deletedPrefixes []string
+	mu      sync.Mutex
+	source  afero.Fs
+	changes afero.Fs
+	// removed are the whiteouts, the removed paths of the source
+	removed map[string]bool
 }
 
-func NewOverlayFs(fs afero.Fs) *OverlayFs {
-	s := &OverlayFs{
-		source:          fs,
-		changes:         afero.NewMemMapFs(),
-		deletedFiles:    make(map[string]bool),
-		deletedPrefixes: []string{},
+// NewOverlayFs returns the overlay of the source with the changes written to
+// the changes file system.
+func NewOverlayFs(fs afero.Fs, changes afero.Fs) *OverlayFs {
+	return &OverlayFs{
+		source:  fs,
+		changes: changes,
+		removed: make(map[string]bool),
 	}
-	s.overlay = afero.NewCopyOnWriteFs(s.source, s.changes)
-	return s
+}
+
+// Source returns the file system with the original files.
+func (r *OverlayFs) Source() afero.Fs {
+	return r.source
+}
+
+// Close releases the changes file system.
+func (r *OverlayFs) Close() error {
+	if closer, ok := r.changes.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Perm returns the permissions of the original file, files written to the
+// overlay get the default ones.
+func (r *OverlayFs) Perm(name string, info os.FileInfo) os.FileMode {
+	if stat, err := r.source.Stat(name); err == nil {
+		return stat.Mode().Perm()
+	}
+	if perm := info.Mode().Perm(); perm != 0 {
+		return perm
+	}
+	return 0644
 }
 
 func (r *OverlayFs) IsChanged() bool {
 	list, _ := afero.ReadDir(r.changes, "")
-	if len(list) > 0 || len(r.deletedFiles) > 0 || len(r.deletedPrefixes) > 0 {
-		return true
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(list) > 0 || len(r.removed) > 0
+}
+
+func (r *OverlayFs) Name() string {
+	return "OverlayFs"
+}
+
+// cleanPath returns the path relative to the root of the overlay, "." for
+// the root.
+func cleanPath(name string) string {
+	return filepath.Clean(strings.TrimPrefix(filepath.Clean(name), string(filepath.Separator)))
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// whitedOut reports whether the path or a folder above it was removed from
+// the source.
+func (r *OverlayFs) whitedOut(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.removed) == 0 {
+		return false
+	}
+	for p := name; p != "."; p = filepath.Dir(p) {
+		if r.removed[p] {
+			return true
+		}
 	}
 	return false
 }
 
-func (r *OverlayFs) ReadDir(name string) ([]os.FileInfo, error) {
-	return afero.ReadDir(r.overlay, name)
+// whiteout hides the source path and everything below it.
+func (r *OverlayFs) whiteout(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for p := range r.removed {
+		if isSubPath(p, name) {
+			delete(r.removed, p)
+		}
+	}
+	r.removed[name] = true
 }
 
-func (r *OverlayFs) Chtimes(n string, a, m time.Time) error {
-	return syscall.EPERM
+// stat returns the info of the visible file, the changed one or else the
+// source one unless removed, and whether it is in the changes.
+func (r *OverlayFs) stat(name string) (os.FileInfo, bool, error) {
+	if info, err := r.changes.Stat(name); err == nil {
+		return info, true, nil
+	} else if !isNotExist(err) {
+		return nil, false, err
+	}
+	if r.whitedOut(name) {
+		return nil, false, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	info, err := r.source.Stat(name)
+	return info, false, err
 }
 
-func (r *OverlayFs) Chmod(n string, m os.FileMode) error {
-	return syscall.EPERM
+// readDir lists the folder, the changed files over the source ones.
+func (r *OverlayFs) readDir(name string) ([]os.FileInfo, error) {
+	entries := make(map[string]os.FileInfo)
+	if !r.whitedOut(name) {
+		list, err := afero.ReadDir(r.source, name)
+		if err != nil && !isNotExist(err) {
+			return nil, err
+		}
+		for _, info := range list {
+			if !r.whitedOut(filepath.Join(name, info.Name())) {
+				entries[info.Name()] = info
+			}
+		}
+	}
+	list, err := afero.ReadDir(r.changes, name)
+	if err != nil && !isNotExist(err) {
+		return nil, err
+	}
+	for _, info := range list {
+		entries[info.Name()] = info
+	}
+
+	result := make([]os.FileInfo, 0, len(entries))
+	for _, info := range entries {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
 }
 
-func (r *OverlayFs) Chown(n string, uid, gid int) error {
-	return syscall.EPERM
+// mkdirChanges creates the visible folder and the ones above it in the
+// changes, with the permissions of the source.
+func (r *OverlayFs) mkdirChanges(dir string) error {
+	if dir == "." {
+		return nil
+	}
+	info, changed, err := r.stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	if changed {
+		return nil
+	}
+	if err := r.mkdirChanges(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := r.changes.Mkdir(dir, info.Mode().Perm()); err != nil {
+		// Created by another writer
+		if info, statErr := r.changes.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return r.changes.Chtimes(dir, info.ModTime(), info.ModTime())
 }
 
-func (r *OverlayFs) Name() string {
-	return "OverlayFs"
+// copyUp copies the source file to the changes, or creates it empty when it
+// will be truncated anyway.
+func (r *OverlayFs) copyUp(name string, info os.FileInfo, truncate bool) error {
+	if err := r.mkdirChanges(filepath.Dir(name)); err != nil {
+		return err
+	}
+	out, err := r.changes.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if !truncate {
+		var in afero.File
+		if in, err = r.source.Open(name); err == nil {
+			_, err = io.Copy(out, in)
+			in.Close()
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = r.changes.Chtimes(name, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		_ = r.changes.Remove(name)
+	}
+	return err
+}
+
+// changedPath makes the visible file or folder writable in the changes.
+func (r *OverlayFs) changedPath(name string) error {
+	info, changed, err := r.stat(name)
+	if err != nil || changed {
+		return err
+	}
+	if info.IsDir() {
+		return r.mkdirChanges(name)
+	}
+	return r.copyUp(name, info, false)
 }
 
 func (r *OverlayFs) Stat(name string) (os.FileInfo, error) {
-	return r.overlay.Stat(name)
+	info, _, err := r.stat(cleanPath(name))
+	return info, err
 }
 
 func (r *OverlayFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
-	if lsf, ok := r.overlay.(afero.Lstater); ok {
-		return lsf.LstatIfPossible(name)
-	}
-	fi, err := r.Stat(name)
-	return fi, false, err
+	info, err := r.Stat(name)
+	return info, false, err
 }
 
-func (r *OverlayFs) SymlinkIfPossible(oldname, newname string) error {
-	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+func (r *OverlayFs) ReadDir(name string) ([]os.FileInfo, error) {
+	return r.readDir(cleanPath(name))
 }
 
-func (r *OverlayFs) ReadlinkIfPossible(name string) (string, error) {
-	if srdr, ok := r.overlay.(afero.LinkReader); ok {
-		return srdr.ReadlinkIfPossible(name)
+func (r *OverlayFs) Open(name string) (afero.File, error) {
+	name = cleanPath(name)
+	info, changed, err := r.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	layer := r.source
+	if changed {
+		layer = r.changes
 	}
+	file, err := layer.Open(name)
+	if err != nil || !info.IsDir() {
+		return file, err
+	}
+	return &overlayDir{File: file, fs: r, name: name}, nil
+}
 
-	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+func (r *OverlayFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		return r.Open(name)
+	}
+	name = cleanPath(name)
+	info, changed, err := r.stat(name)
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case err == nil && info.IsDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case err == nil && !changed:
+		if err := r.copyUp(name, info, flag&os.O_TRUNC != 0); err != nil {
+			return nil, err
+		}
+	case err == nil:
+	case !isNotExist(err) || flag&os.O_CREATE == 0:
+		return nil, err
+	default:
+		if err := r.mkdirChanges(filepath.Dir(name)); err != nil {
+			return nil, err
+		}
+	}
+	return r.changes.OpenFile(name, flag, perm)
 }
 
-func (r *OverlayFs) Rename(o, n string) error {
-	return syscall.EPERM
+func (r *OverlayFs) Create(name string) (afero.File, error) {
+	return r.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 }
 
-func (r *OverlayFs) RemoveAll(p string) error {
-	justDeleted := false
-	if exists, _ := afero.Exists(r.source, p); exists {
-		clean := filepath.Clean(p)
-		alreadyDeleted := false
-		for _, prefix := range r.deletedPrefixes {
-			if prefix == clean {
-				alreadyDeleted = true
-				break
-			}
-		}
-		if !alreadyDeleted {
-			r.deletedPrefixes = append(r.deletedPrefixes, clean)
-			justDeleted = true
+func (r *OverlayFs) Mkdir(name string, perm os.FileMode) error {
+	name = cleanPath(name)
+	if _, _, err := r.stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	} else if !isNotExist(err) {
+		return err
+	}
+	if err := r.mkdirChanges(filepath.Dir(name)); err != nil {
+		return err
+	}
+	return r.changes.Mkdir(name, perm)
+}
+
+func (r *OverlayFs) MkdirAll(path string, perm os.FileMode) error {
+	path = cleanPath(path)
+	if info, _, err := r.stat(path); err == nil {
+		if info.IsDir() {
+			return nil
 		}
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+	} else if !isNotExist(err) {
+		return err
+	}
+	if err := r.MkdirAll(filepath.Dir(path), perm); err != nil {
+		return err
 	}
-	if err := r.overlay.RemoveAll(p); err != nil {
-		if justDeleted {
+	if err := r.Mkdir(path, perm); err != nil {
+		if info, _, statErr := r.stat(path); statErr == nil && info.IsDir() {
 			return nil
 		}
 		return err
@@ -110,52 +322,297 @@ func (r *OverlayFs) RemoveAll(p string) error {
 	return nil
 }
 
-func (r *OverlayFs) Remove(n string) error {
-	err0 := r.overlay.Remove(n)
+func (r *OverlayFs) Remove(name string) error {
+	name = cleanPath(name)
+	info, changed, err := r.stat(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if info.IsDir() {
+		if list, err := r.readDir(name); err != nil {
+			return err
+		} else if len(list) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if changed {
+		if err := r.changes.Remove(name); err != nil {
+			return err
+		}
+	}
+	if _, err := r.source.Stat(name); err == nil && !r.whitedOut(name) {
+		r.whiteout(name)
+	}
+	return nil
+}
 
-	if exists, _ := afero.Exists(r.source, n); exists {
-		if err := r.IsRemoved(n); err != nil {
+func (r *OverlayFs) RemoveAll(path string) error {
+	path = cleanPath(path)
+	if path == "." {
+		return &os.PathError{Op: "RemoveAll", Path: path, Err: syscall.EINVAL}
+	}
+	_, changed, err := r.stat(path)
+	if isNotExist(err) {
+		// Like os.RemoveAll, a path below a file is an error
+		for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+			if info, _, err := r.stat(dir); err == nil {
+				if !info.IsDir() {
+					return &os.PathError{Op: "RemoveAll", Path: path, Err: syscall.ENOTDIR}
+				}
+				break
+			}
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if changed {
+		if err := r.changes.RemoveAll(path); err != nil {
 			return err
 		}
-		r.deletedFiles[filepath.Clean(n)] = true
+	}
+	if _, err := r.source.Stat(path); err == nil && !r.whitedOut(path) {
+		r.whiteout(path)
+	}
+	return nil
+}
+
+func (r *OverlayFs) Rename(oldname, newname string) error {
+	oldname, newname = cleanPath(oldname), cleanPath(newname)
+	linkError := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	info, _, err := r.stat(oldname)
+	if err != nil {
+		return linkError(err)
+	}
+	if oldname == newname {
 		return nil
 	}
+	if oldname == "." || isSubPath(newname, oldname) {
+		return linkError(syscall.EINVAL)
+	}
+	if target, _, err := r.stat(newname); err == nil {
+		// Like os.Rename, only files are replaced
+		switch {
+		case target.IsDir():
+			return linkError(syscall.EEXIST)
+		case info.IsDir():
+			return linkError(syscall.ENOTDIR)
+		}
+		if err := r.RemoveAll(newname); err != nil {
+			return linkError(err)
+		}
+	} else if !isNotExist(err) {
+		return linkError(err)
+	}
+	if err := r.mkdirChanges(filepath.Dir(newname)); err != nil {
+		return linkError(err)
+	}
+	if err := r.move(oldname, newname, info); err != nil {
+		return linkError(err)
+	}
+	return r.RemoveAll(oldname)
+}
 
-	return err0
+// move moves the visible file or folder to the changes under the new name.
+func (r *OverlayFs) move(oldname, newname string, info os.FileInfo) error {
+	if !info.IsDir() {
+		if _, err := r.changes.Stat(oldname); err == nil {
+			return r.changes.Rename(oldname, newname)
+		}
+		out, err := r.changes.OpenFile(newname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		in, err := r.source.Open(oldname)
+		if err == nil {
+			_, err = io.Copy(out, in)
+			in.Close()
+		}
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		return r.changes.Chtimes(newname, info.ModTime(), info.ModTime())
+	}
+
+	list, err := r.readDir(oldname)
+	if err != nil {
+		return err
+	}
+	if err := r.changes.Mkdir(newname, info.Mode().Perm()); err != nil {
+		return err
+	}
+	for _, child := range list {
+		if err := r.move(filepath.Join(oldname, child.Name()), filepath.Join(newname, child.Name()), child); err != nil {
+			return err
+		}
+	}
+	return r.changes.Chtimes(newname, info.ModTime(), info.ModTime())
 }
 
-func (r *OverlayFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
-	return r.overlay.OpenFile(name, flag, perm)
+func (r *OverlayFs) Chmod(name string, mode os.FileMode) error {
+	name = cleanPath(name)
+	if err := r.changedPath(name); err != nil {
+		return err
+	}
+	return r.changes.Chmod(name, mode)
 }
 
-func (r *OverlayFs) Open(n string) (afero.File, error) {
-	return r.overlay.Open(n)
+func (r *OverlayFs) Chown(name string, uid, gid int) error {
+	name = cleanPath(name)
+	if err := r.changedPath(name); err != nil {
+		return err
+	}
+	return r.changes.Chown(name, uid, gid)
 }
 
-func (r *OverlayFs) Mkdir(n string, p os.FileMode) error {
-	// Тут надо зафиксить удаление
-	return r.overlay.Mkdir(n, p)
+func (r *OverlayFs) Chtimes(name string, atime, mtime time.Time) error {
+	name = cleanPath(name)
+	if err := r.changedPath(name); err != nil {
+		return err
+	}
+	return r.changes.Chtimes(name, atime, mtime)
 }
 
-func (r *OverlayFs) MkdirAll(n string, p os.FileMode) error {
-	// И тут тоже
-	return r.overlay.MkdirAll(n, p)
+func (r *OverlayFs) SymlinkIfPossible(oldname, newname string) error {
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
 }
 
-func (r *OverlayFs) Create(n string) (afero.File, error) {
-	file, err := r.overlay.Create(n)
-	delete(r.deletedFiles, filepath.Clean(n))
-	return file, err
+func (r *OverlayFs) ReadlinkIfPossible(name string) (string, error) {
+	name = cleanPath(name)
+	if _, changed, err := r.stat(name); err != nil {
+		return "", err
+	} else if lr, ok := r.source.(afero.LinkReader); ok && !changed {
+		return lr.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
 }
 
+// IsRemoved returns an error if the path of the source was removed and not
+// created again.
 func (r *OverlayFs) IsRemoved(path string) error {
-	if _, ok := r.deletedFiles[path]; ok {
-		return &os.PathError{Op: "cc fileRemoved", Path: path, Err: afero.ErrFileNotFound}
+	path = cleanPath(path)
+	if _, err := r.changes.Stat(path); err == nil || !r.whitedOut(path) {
+		return nil
 	}
-	for _, prefix := range r.deletedPrefixes {
-		if strings.HasPrefix(path, prefix) {
-			return &os.PathError{Op: "cc dirRemoved", Path: path, Err: afero.ErrFileNotFound}
+	return &os.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+}
+
+// Changes returns the files and folders written to the overlay and the
+// removed files and folders of the source. A source path replaced by one of
+// another type is both removed and written.
+func (r *OverlayFs) Changes() (written, removed []string, err error) {
+	err = afero.Walk(r.changes, "", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
+		if path = cleanPath(path); path != "." {
+			written = append(written, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil
+
+	r.mu.Lock()
+	whiteouts := make([]string, 0, len(r.removed))
+	for path := range r.removed {
+		whiteouts = append(whiteouts, path)
+	}
+	r.mu.Unlock()
+	if removed, err = r.removedPaths(".", whiteouts); err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(removed)
+	return written, removed, nil
+}
+
+// removedPaths lists the hidden paths of the source folder. Folders created
+// again after removal are descended to list their hidden files.
+func (r *OverlayFs) removedPaths(dir string, whiteouts []string) ([]string, error) {
+	list, err := afero.ReadDir(r.source, dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, info := range list {
+		path := filepath.Join(dir, info.Name())
+		related := false
+		for _, w := range whiteouts {
+			if isSubPath(path, w) || isSubPath(w, path) {
+				related = true
+				break
+			}
+		}
+		if !related {
+			continue
+		}
+
+		changed, err := r.changes.Stat(path)
+		if err != nil && !isNotExist(err) {
+			return nil, err
+		}
+		switch {
+		case err == nil && changed.IsDir() == info.IsDir():
+		case err == nil || r.whitedOut(path):
+			removed = append(removed, path)
+			continue
+		}
+		if info.IsDir() {
+			below, err := r.removedPaths(path, whiteouts)
+			if err != nil {
+				return nil, err
+			}
+			removed = append(removed, below...)
+		}
+	}
+	return removed, nil
+}
+
+// overlayDir is a folder of the overlay listing the changed and the visible
+// source files.
+type overlayDir struct {
+	afero.File
+	fs      *OverlayFs
+	name    string
+	entries []os.FileInfo
+	read    bool
+}
+
+func (d *overlayDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		entries, err := d.fs.readDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if count <= 0 {
+		list := d.entries
+		d.entries = nil
+		return list, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	list := d.entries[:count]
+	d.entries = d.entries[count:]
+	return list, nil
+}
+
+func (d *overlayDir) Readdirnames(count int) ([]string, error) {
+	list, err := d.Readdir(count)
+	names := make([]string, len(list))
+	for i, info := range list {
+		names[i] = info.Name()
+	}
+	return names, err
 }
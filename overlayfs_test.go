@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// newSourceFs returns a world-like tree where the names of files and folders
+// collide at several depths, and names prefix others.
+func newSourceFs(t *testing.T) afero.Fs {
+	t.Helper()
+	fs := afero.NewMemMapFs()
+	for _, dir := range []string{"a/b/c", "ab", "c"} {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"f", "b", "a/f", "a/b/f", "a/bc", "a/b/c/f", "ab/f", "c/a"} {
+		if err := afero.WriteFile(fs, name, []byte("source "+name), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+// fsEntry is a file or folder of a snapshot.
+type fsEntry struct {
+	dir  bool
+	perm os.FileMode
+	data string
+}
+
+// snapshot returns the files and folders below the root by their paths.
+func snapshot(t *testing.T, fs afero.Fs, root string) map[string]fsEntry {
+	t.Helper()
+	entries, err := readTree(fs, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func readTree(fs afero.Fs, root string) (map[string]fsEntry, error) {
+	entries := make(map[string]fsEntry)
+	err := afero.Walk(fs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(cleanPath(root), cleanPath(path))
+		if err != nil || rel == "." {
+			return err
+		}
+		entry := fsEntry{dir: info.IsDir(), perm: info.Mode().Perm()}
+		if !info.IsDir() {
+			data, err := afero.ReadFile(fs, path)
+			if err != nil {
+				return err
+			}
+			entry.data = string(data)
+		}
+		entries[rel] = entry
+		return nil
+	})
+	return entries, err
+}
+
+// restore writes the snapshot below the root.
+func restore(fs afero.Fs, root string, entries map[string]fsEntry) error {
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		entry, name := entries[path], filepath.Join(root, path)
+		var err error
+		if entry.dir {
+			err = fs.MkdirAll(name, entry.perm)
+		} else {
+			err = afero.WriteFile(fs, name, []byte(entry.data), entry.perm)
+		}
+		if err == nil {
+			err = fs.Chmod(name, entry.perm)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overlayOp is an operation run on the overlay, then on the reference file
+// system if the overlay accepted it.
+type overlayOp struct {
+	name string
+	run  func(fs afero.Fs) error
+	// ref replaces run on the reference, for operations a MemMapFs does
+	// differently
+	ref func(fs afero.Fs) error
+}
+
+func randomOverlayOp(rnd *rand.Rand, step int) overlayOp {
+	// ab and bc have a name as prefix, like region and region2
+	names := []string{"a", "ab", "b", "bc", "c", "f"}
+	randomPath := func() string {
+		parts := make([]string, 1+rnd.Intn(3))
+		for i := range parts {
+			parts[i] = names[rnd.Intn(len(names))]
+		}
+		return filepath.Join(parts...)
+	}
+
+	path := randomPath()
+	switch rnd.Intn(7) {
+	case 0:
+		data := fmt.Sprint("created ", step)
+		return overlayOp{name: "create " + path, run: func(fs afero.Fs) error {
+			// MemMapFs.Create leaves the permissions empty
+			f, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteString(data)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		}}
+	case 1:
+		data := fmt.Sprint(" appended ", step)
+		return overlayOp{name: "append " + path, run: func(fs afero.Fs) error {
+			f, err := fs.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteString(data)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		}}
+	case 2:
+		return overlayOp{name: "remove " + path, run: func(fs afero.Fs) error {
+			return fs.Remove(path)
+		}}
+	case 3:
+		return overlayOp{name: "remove all " + path, run: func(fs afero.Fs) error {
+			return fs.RemoveAll(path)
+		}}
+	case 4:
+		return overlayOp{name: "mkdir " + path, run: func(fs afero.Fs) error {
+			return fs.Mkdir(path, 0750)
+		}}
+	case 5:
+		perm := []os.FileMode{0600, 0644, 0700, 0755}[rnd.Intn(4)]
+		return overlayOp{name: fmt.Sprintf("chmod %s %o", path, perm), run: func(fs afero.Fs) error {
+			return fs.Chmod(path, perm)
+		}}
+	}
+	newPath := randomPath()
+	return overlayOp{
+		name: "rename " + path + " " + newPath,
+		run: func(fs afero.Fs) error {
+			return fs.Rename(path, newPath)
+		},
+		// A MemMapFs renames a folder without its files, they are copied
+		ref: func(fs afero.Fs) error {
+			if path == newPath {
+				return nil
+			}
+			entries, err := readTree(fs, path)
+			if err != nil {
+				return err
+			}
+			info, err := fs.Stat(path)
+			if err != nil {
+				return err
+			}
+			if err := fs.RemoveAll(newPath); err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return fs.Rename(path, newPath)
+			}
+			if err := fs.Mkdir(newPath, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := restore(fs, newPath, entries); err != nil {
+				return err
+			}
+			return fs.RemoveAll(path)
+		},
+	}
+}
+
+func TestOverlayFs_RandomOperations(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testOverlayRandomOperations(t, func() afero.Fs { return afero.NewMemMapFs() })
+	})
+	// Every file closed after writing is spilled to disk
+	t.Run("spilled", func(t *testing.T) {
+		testOverlayRandomOperations(t, func() afero.Fs {
+			return newSpillFs(t.TempDir(), ".w.*.trim-spill", 1)
+		})
+	})
+}
+
+// testOverlayRandomOperations checks random operations on overlays with the
+// changes layers.
+func testOverlayRandomOperations(t *testing.T, newChanges func() afero.Fs) {
+	for seed := int64(1); seed <= 200; seed++ {
+		source := newSourceFs(t)
+		original := snapshot(t, source, "")
+		changes := newChanges()
+		overlay := NewOverlayFs(afero.NewReadOnlyFs(source), changes)
+		reference := afero.NewMemMapFs()
+		if err := restore(reference, "", original); err != nil {
+			t.Fatal(err)
+		}
+
+		rnd := rand.New(rand.NewSource(seed))
+		var done []string
+		for step := 0; step < 50; step++ {
+			op := randomOverlayOp(rnd, step)
+			// A MemMapFs accepts more than the OS, like files without a
+			// folder, so only the operations the overlay accepts are checked
+			if err := op.run(overlay); err != nil {
+				continue
+			}
+			done = append(done, op.name)
+			ref := op.run
+			if op.ref != nil {
+				ref = op.ref
+			}
+			if err := ref(reference); err != nil {
+				t.Fatalf("seed %d: %s on the reference: %v\nafter %s", seed, op.name, err, strings.Join(done, ", "))
+			}
+			if want, got := snapshot(t, reference, ""), snapshot(t, overlay, ""); !reflect.DeepEqual(want, got) {
+				t.Fatalf("seed %d: overlay differs after %s:\nwant %v\n got %v", seed, strings.Join(done, ", "), want, got)
+			}
+		}
+
+		if got := snapshot(t, source, ""); !reflect.DeepEqual(original, got) {
+			t.Fatalf("seed %d: source changed after %s", seed, strings.Join(done, ", "))
+		}
+
+		// Applying the changes to a copy of the source gives the overlay
+		written, removed, err := overlay.Changes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied := afero.NewMemMapFs()
+		if err := restore(applied, "", original); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range removed {
+			if err := applied.RemoveAll(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		changed := make(map[string]fsEntry)
+		all := snapshot(t, overlay, "")
+		for _, path := range written {
+			changed[path] = all[path]
+		}
+		if err := restore(applied, "", changed); err != nil {
+			t.Fatal(err)
+		}
+		if want, got := snapshot(t, reference, ""), snapshot(t, applied, ""); !reflect.DeepEqual(want, got) {
+			t.Fatalf("seed %d: changes %v, removed %v do not give the overlay after %s:\nwant %v\n got %v",
+				seed, written, removed, strings.Join(done, ", "), want, got)
+		}
+		if c, ok := changes.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestOverlayFs_Changes(t *testing.T) {
+	overlay := NewOverlayFs(afero.NewReadOnlyFs(newSourceFs(t)), afero.NewMemMapFs())
+	if err := overlay.RemoveAll("a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.Mkdir("a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(overlay, "a/b/n", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.Rename("f", "g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.Remove("c/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.Mkdir("c/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	written, removed, err := overlay.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "a/b", "a/b/n", "c", "c/a", "g"}; !reflect.DeepEqual(written, want) {
+		t.Errorf("written %v, want %v", written, want)
+	}
+	// The file c/a replaced by a folder is both removed and written
+	if want := []string{"a/b/c", "a/b/f", "c/a", "f"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	if err := overlay.IsRemoved("a/b/f"); err == nil {
+		t.Error("a/b/f is not removed")
+	}
+	if err := overlay.IsRemoved("a/b"); err != nil {
+		t.Errorf("a/b is removed: %v", err)
+	}
+}
+
+func TestOverlayFs_RemovePrefix(t *testing.T) {
+	source := afero.NewMemMapFs()
+	for _, dir := range []string{"region", "region2"} {
+		if err := source.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"region/r.0.0.mca", "region2/r.0.0.mca", "regions.yml"} {
+		if err := afero.WriteFile(source, name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	overlay := NewOverlayFs(afero.NewReadOnlyFs(source), afero.NewMemMapFs())
+	if err := overlay.RemoveAll("region"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"region", "region/r.0.0.mca"} {
+		if err := overlay.IsRemoved(name); err == nil {
+			t.Errorf("%s is not removed", name)
+		}
+	}
+	// Removing region hides nothing of region2
+	for _, name := range []string{"region2", "region2/r.0.0.mca", "regions.yml"} {
+		if err := overlay.IsRemoved(name); err != nil {
+			t.Errorf("%s is removed: %v", name, err)
+		}
+		if _, err := overlay.Stat(name); err != nil {
+			t.Errorf("%s is hidden: %v", name, err)
+		}
+	}
+	if got, want := snapshot(t, overlay, ""), map[string]fsEntry{
+		"region2":           {dir: true, perm: 0755},
+		"region2/r.0.0.mca": {perm: 0644, data: "region2/r.0.0.mca"},
+		"regions.yml":       {perm: 0644, data: "regions.yml"},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("overlay %v, want %v", got, want)
+	}
+}
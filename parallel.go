@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+)
+
+// forEachOrdered calls work for every index in [0, n) using up to workers
+// goroutines. done is called on the caller's goroutine in ascending index
+// order, as soon as the work for the index and all previous ones has
+// finished, so output produced there does not depend on scheduling.
+//
+// After the first failure no new work is started and the error with the
+// lowest index is returned.
+func forEachOrdered(workers, n int, work func(i int) error, done func(i int)) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	type result struct {
+		i   int
+		err error
+	}
+	next := make(chan int)
+	results := make(chan result)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results <- result{i, work(i)}
+			}
+		}()
+	}
+	go func() {
+		defer close(next)
+		for i := 0; i < n; i++ {
+			select {
+			case next <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	finished := make(map[int]bool)
+	pending := 0
+	errIndex := -1
+	var err error
+	for r := range results {
+		if r.err != nil {
+			if err == nil {
+				close(stop)
+			}
+			if err == nil || r.i < errIndex {
+				err, errIndex = r.err, r.i
+			}
+		}
+		if err != nil {
+			continue
+		}
+		finished[r.i] = true
+		for finished[pending] {
+			delete(finished, pending)
+			done(pending)
+			pending++
+		}
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runOrdered runs forEachOrdered with random delays of the work, failing
+// the items in fail, and returns the indices passed to done.
+func runOrdered(t *testing.T, workers, n int, fail map[int]bool) ([]int, error) {
+	t.Helper()
+	delays := make([]time.Duration, n)
+	rnd := rand.New(rand.NewSource(int64(workers*1000 + n)))
+	for i := range delays {
+		delays[i] = time.Duration(rnd.Intn(500)) * time.Microsecond
+	}
+
+	var mu sync.Mutex
+	calls := make(map[int]int)
+	var order []int
+	var err error
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		err = forEachOrdered(workers, n, func(i int) error {
+			mu.Lock()
+			calls[i]++
+			mu.Unlock()
+			time.Sleep(delays[i])
+			if fail[i] {
+				return fmt.Errorf("item %d failed", i)
+			}
+			return nil
+		}, func(i int) {
+			order = append(order, i)
+		})
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%d workers, %d items: deadlock", workers, n)
+	}
+	for i, count := range calls {
+		if count != 1 {
+			t.Errorf("%d workers, %d items: item %d worked %d times", workers, n, i, count)
+		}
+	}
+	return order, err
+}
+
+func TestForEachOrdered(t *testing.T) {
+	for _, tc := range []struct{ workers, n int }{
+		{1, 50}, {4, 100}, {8, 3}, {200, 20}, {0, 5}, {4, 0},
+	} {
+		order, err := runOrdered(t, tc.workers, tc.n, nil)
+		if err != nil {
+			t.Errorf("%d workers, %d items: %v", tc.workers, tc.n, err)
+		}
+		if len(order) != tc.n {
+			t.Errorf("%d workers, %d items: done called %d times", tc.workers, tc.n, len(order))
+		}
+		for i, done := range order {
+			if done != i {
+				t.Fatalf("%d workers, %d items: done called in order %v", tc.workers, tc.n, order)
+			}
+		}
+	}
+}
+
+func TestForEachOrdered_Error(t *testing.T) {
+	for _, workers := range []int{1, 4, 100} {
+		// The later item may fail first, the earlier one has been started
+		// before and its error is returned
+		order, err := runOrdered(t, workers, 50, map[int]bool{20: true, 30: true})
+		if err == nil || err.Error() != "item 20 failed" {
+			t.Errorf("%d workers: error %v, want the error of item 20", workers, err)
+		}
+		for i, done := range order {
+			if done != i || done >= 20 {
+				t.Fatalf("%d workers: done called for %v", workers, order)
+			}
+		}
+	}
+
+	err := forEachOrdered(2, 10, func(i int) error {
+		return errors.New("failed")
+	}, func(i int) {
+		t.Errorf("done called for failed item %d", i)
+	})
+	if err == nil {
+		t.Error("no error returned")
+	}
+}
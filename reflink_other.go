@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoReflink = errors.New("reflink not supported")
+
+// reflink is only supported on Linux.
+func reflink(dst, src *os.File) error {
+	return errNoReflink
+}
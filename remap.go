@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"mc-world-trimmer/chunk"
+)
+
+// loadBlockRemap reads a block remap file with a rule "id[:data] -> id[:data]"
+// per line and # comments. Without the data value the rule matches any data
+// on the left and keeps it on the right.
+func loadBlockRemap(path string) (*chunk.BlockRemap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	remap := chunk.NewBlockRemap()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(text, "->")
+		if !ok {
+			return nil, fmt.Errorf("%s line %d: expected id[:data] -> id[:data]", path, line)
+		}
+		fromID, fromData, err := parseBlock(from)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		toID, toData, err := parseBlock(to)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		remap.Set(fromID, fromData, toID, toData)
+	}
+	return remap, scanner.Err()
+}
+
+// parseBlock parses id[:data], data is -1 if omitted.
+func parseBlock(s string) (id, data int, err error) {
+	idText, dataText, hasData := strings.Cut(strings.TrimSpace(s), ":")
+	if id, err = strconv.Atoi(strings.TrimSpace(idText)); err != nil {
+		return
+	}
+	if id < 0 || id > 4095 {
+		return 0, 0, fmt.Errorf("block id %d out of range", id)
+	}
+	data = -1
+	if hasData {
+		if data, err = strconv.Atoi(strings.TrimSpace(dataText)); err != nil {
+			return
+		}
+		if data < 0 || data > 15 {
+			return 0, 0, fmt.Errorf("block data %d out of range", data)
+		}
+	}
+	return
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"mc-world-trimmer/chunk"
+
+	"github.com/spf13/afero"
+)
+
+// maxRenderPixels limits the size of rendered maps, about 1 GB of memory.
+const maxRenderPixels = 1 << 28
+
+// mapChunk holds the columns of a chunk as drawn on maps.
+type mapChunk struct {
+	heights [256]int16
+	colors  [256]uint8
+	depths  [256]uint8
+}
+
+// chunkMapper draws the 1.8 chunks of a region file.
+type chunkMapper struct {
+	area   *CropArea
+	chunks map[ChunkPos]*mapChunk
+}
+
+func (m *chunkMapper) visit(pos ChunkPos, c chunk.Chunk) error {
+	c18, ok := c.(*chunk.Chunk_1_8_8)
+	if !ok || m.area != nil && !m.area.containsChunk(pos) {
+		return nil
+	}
+	mc := new(mapChunk)
+	for z := 0; z < 16; z++ {
+		for x := 0; x < 16; x++ {
+			y, color, depth := c18.MapColumn(x, z)
+			if depth > 255 {
+				depth = 255
+			}
+			mc.heights[z<<4|x] = int16(y)
+			mc.colors[z<<4|x] = color
+			mc.depths[z<<4|x] = uint8(depth)
+		}
+	}
+	m.chunks[pos] = mc
+	return nil
+}
+
+// renderMap draws the chunks with the shading of maps: blocks higher than the
+// block north of them are lighter, lower blocks darker, and deep water darker.
+func renderMap(chunks map[ChunkPos]*mapChunk) (*image.NRGBA, error) {
+	first := true
+	var bounds CropArea
+	for pos := range chunks {
+		if first || pos.X < bounds.MinX {
+			bounds.MinX = pos.X
+		}
+		if first || pos.Z < bounds.MinZ {
+			bounds.MinZ = pos.Z
+		}
+		if first || pos.X > bounds.MaxX {
+			bounds.MaxX = pos.X
+		}
+		if first || pos.Z > bounds.MaxZ {
+			bounds.MaxZ = pos.Z
+		}
+		first = false
+	}
+	if first {
+		return nil, fmt.Errorf("no 1.8 chunks to render")
+	}
+	width := (bounds.MaxX - bounds.MinX + 1) << 4
+	height := (bounds.MaxZ - bounds.MinZ + 1) << 4
+	if int64(width)*int64(height) > maxRenderPixels {
+		return nil, fmt.Errorf("map of %dx%d pixels too large, limit the area", width, height)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for pos, mc := range chunks {
+		north := chunks[ChunkPos{pos.X, pos.Z - 1}]
+		for z := 0; z < 16; z++ {
+			for x := 0; x < 16; x++ {
+				idx := z<<4 | x
+				if mc.colors[idx] == 0 {
+					continue
+				}
+				h := mc.heights[idx]
+				northHeight := h
+				if z > 0 {
+					northHeight = mc.heights[idx-16]
+				} else if north != nil {
+					northHeight = north.heights[idx+240]
+				}
+
+				dither := float64((x + z) & 1)
+				shade := 1
+				if mc.depths[idx] > 0 {
+					d := float64(mc.depths[idx])*0.1 + dither*0.2
+					if d < 0.5 {
+						shade = 2
+					} else if d > 0.9 {
+						shade = 0
+					}
+				} else {
+					d := float64(h-northHeight)*0.8 + (dither-0.5)*0.4
+					if d > 0.6 {
+						shade = 2
+					} else if d < -0.6 {
+						shade = 0
+					}
+				}
+				img.SetNRGBA((pos.X-bounds.MinX)<<4+x, (pos.Z-bounds.MinZ)<<4+z,
+					shadeColor(chunk.MapColors_1_8_8[mc.colors[idx]], shade))
+			}
+		}
+	}
+	return img, nil
+}
+
+// shadeColor darkens the base color of maps by the shade from 0 to 2.
+func shadeColor(c color.RGBA, shade int) color.NRGBA {
+	factor := [3]uint32{180, 220, 255}[shade]
+	return color.NRGBA{
+		R: uint8(uint32(c.R) * factor / 255),
+		G: uint8(uint32(c.G) * factor / 255),
+		B: uint8(uint32(c.B) * factor / 255),
+		A: 255,
+	}
+}
+
+// renderWorld draws the chunks of a dimension of the world inside the area.
+func renderWorld(fs afero.Fs, dir string, area *CropArea, workers int) (*image.NRGBA, error) {
+	chunks := make(map[ChunkPos]*mapChunk)
+	err := walkChunks(fs, filepath.Join(dir, "region"), workers, func() chunkVisitor {
+		return &chunkMapper{area, make(map[ChunkPos]*mapChunk)}
+	}, func(v chunkVisitor) {
+		for pos, mc := range v.(*chunkMapper).chunks {
+			chunks[pos] = mc
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return renderMap(chunks)
+}
+
+// renderCommand draws top-down maps of worlds to PNG files.
+func renderCommand(args []string) {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	output := flags.String("out", "map.png", "Write the PNG image to the `file`")
+	dim := flags.String("dim", "overworld", "Dimension to render, overworld, nether or end")
+	areaBox := flags.String("area", "", "Render only the chunks touched by the box of blocks `x1,z1,x2,z2`")
+	workers := flags.Int("j", runtime.NumCPU(), "Number of region files read in parallel")
+	flags.Usage = func() {
+		w := flags.Output()
+		base := filepath.Base(os.Args[0])
+		fmt.Fprintln(w, "Usage:")
+		fmt.Fprintln(w, " ", base, "render [options] path")
+		fmt.Fprintln(w, "Examples:")
+		fmt.Fprintln(w, " ", base, "render -out before.png world")
+		fmt.Fprintln(w, " ", base, "render -area -512,-512,511,511 -out after.png world_opt.zip")
+		fmt.Fprintln(w, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return
+	}
+
+	dimDir, ok := map[string]string{"overworld": "", "nether": "DIM-1", "end": "DIM1"}[*dim]
+	if !ok {
+		log.Fatalln("unknown dimension", *dim)
+	}
+	var area *CropArea
+	if *areaBox != "" {
+		x1, z1, x2, z2, err := parseBox(*areaBox)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		area = CropBlocks(x1, z1, x2, z2)
+	}
+
+	handleInterrupt()
+
+	path := strings.Join(flags.Args(), " ")
+	source := NewArchiveSource(path)
+	world := ""
+	if source != nil {
+		// The world may be in a folder of the archive
+		dirs, err := findWorldDirs(source.Fs())
+		if err != nil {
+			fatal(err)
+		}
+		for _, dir := range dirs {
+			if ok, err := isWorldDir(source.Fs(), dir); err != nil {
+				fatal(err)
+			} else if ok {
+				world = dir
+				break
+			}
+		}
+	} else {
+		source = NewDirSource(path)
+	}
+	defer source.Close()
+
+	log.Println(source.Name(), []string{world, *dim, "render..."})
+	img, err := renderWorld(source.Fs(), filepath.Join(world, dimDir), area, *workers)
+	if err != nil {
+		fatal(path, err)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		fatal(err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		fatal(err)
+	}
+	log.Println(source.Name(), []string{world, *dim, "rendered to", *output})
+}
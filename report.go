@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"mc-world-trimmer/chunk"
+)
+
+// WorldReport is the record of an optimized world.
+type WorldReport struct {
+	Source       string             `json:"source"`
+	World        string             `json:"world"`
+	DryRun       bool               `json:"dry_run"`
+	Started      time.Time          `json:"started"`
+	DurationMs   int64              `json:"duration_ms"`
+	Dimensions   []*DimensionReport `json:"dimensions"`
+	DeletedFiles []string           `json:"deleted_files"`
+}
+
+// DimensionReport is the record of a dimension folder of a world, empty for
+// the overworld.
+type DimensionReport struct {
+	Dimension  string          `json:"dimension"`
+	Started    time.Time       `json:"started"`
+	DurationMs int64           `json:"duration_ms"`
+	Folders    []*FolderReport `json:"folders"`
+	LowMap     *LowMapReport   `json:"lowmap,omitempty"`
+}
+
+// FolderReport is the record of a folder with region files: region,
+// entities or poi.
+type FolderReport struct {
+	Folder              string          `json:"folder"`
+	SizeBefore          uint64          `json:"size_before"`
+	SizeAfter           uint64          `json:"size_after"`
+	ChunksKept          int             `json:"chunks_kept"`
+	ChunksUpdated       int             `json:"chunks_updated"`
+	ChunksRemoved       int             `json:"chunks_removed"`
+	SectionsRemoved     int             `json:"sections_removed"`
+	LightRemoved        int             `json:"light_removed"`
+	EntitiesRemoved     map[string]int  `json:"entities_removed,omitempty"`
+	TileEntitiesRemoved int             `json:"tile_entities_removed"`
+	BlocksRemapped      int             `json:"blocks_remapped"`
+	HeightMapMismatches int             `json:"height_map_mismatches"`
+	Regions             []*RegionReport `json:"regions"`
+}
+
+// RegionReport is the record of a region file. Kept chunks include the
+// updated ones.
+type RegionReport struct {
+	File            string `json:"file"`
+	SizeBefore      uint64 `json:"size_before"`
+	SizeAfter       uint64 `json:"size_after"`
+	Removed         bool   `json:"removed"`
+	Updated         bool   `json:"updated"`
+	ChunksKept      int    `json:"chunks_kept"`
+	ChunksUpdated   int    `json:"chunks_updated"`
+	ChunksRemoved   int    `json:"chunks_removed"`
+	SectionsRemoved int    `json:"sections_removed"`
+	// LightRemoved is the number of bytes of light data stripped before
+	// compression
+	LightRemoved int `json:"light_removed"`
+	// EntitiesRemoved is the number of removed entities by ID
+	EntitiesRemoved map[string]int `json:"entities_removed,omitempty"`
+	// TileEntitiesRemoved lists the removed orphaned tile entities
+	TileEntitiesRemoved []chunk.RemovedTileEntity `json:"tile_entities_removed,omitempty"`
+	BlocksRemapped      int                       `json:"blocks_remapped"`
+	// HeightMapMismatches is the number of columns with a stale height map
+	HeightMapMismatches int `json:"height_map_mismatches"`
+}
+
+// LowMapReport describes the computed low map of a dimension.
+type LowMapReport struct {
+	Chunks       int `json:"chunks"`
+	EmptyColumns int `json:"empty_columns"`
+	MinY         int `json:"min_y"`
+	MaxY         int `json:"max_y"`
+}
+
+func (r *WorldReport) finish(started time.Time) {
+	r.Started = started
+	r.DurationMs = time.Since(started).Milliseconds()
+}
+
+func (r *DimensionReport) finish(started time.Time) {
+	r.Started = started
+	r.DurationMs = time.Since(started).Milliseconds()
+}
+
+func (r *FolderReport) add(file os.FileInfo, res *regionResult) {
+	region := &RegionReport{
+		File:            file.Name(),
+		SizeBefore:      uint64(file.Size()),
+		SizeAfter:       res.newSize,
+		Removed:         res.removed,
+		Updated:         res.updated,
+		ChunksKept:      res.chunks - res.chunksRemoved,
+		ChunksUpdated:   res.chunksUpdated,
+		ChunksRemoved:   res.chunksRemoved,
+		SectionsRemoved: res.sectionsRemoved,
+		LightRemoved:    res.lightRemoved,
+		EntitiesRemoved: res.entitiesRemoved,
+
+		TileEntitiesRemoved: res.tileEntitiesRemoved,
+		BlocksRemapped:      res.blocksRemapped,
+	}
+	for _, m := range res.heightMapMismatches {
+		region.HeightMapMismatches += m.columns
+	}
+	r.Regions = append(r.Regions, region)
+	r.SizeBefore += region.SizeBefore
+	r.SizeAfter += region.SizeAfter
+	r.ChunksKept += region.ChunksKept
+	r.ChunksUpdated += region.ChunksUpdated
+	r.ChunksRemoved += region.ChunksRemoved
+	r.SectionsRemoved += region.SectionsRemoved
+	r.LightRemoved += region.LightRemoved
+	r.TileEntitiesRemoved += len(region.TileEntitiesRemoved)
+	r.BlocksRemapped += region.BlocksRemapped
+	r.HeightMapMismatches += region.HeightMapMismatches
+	for id, n := range region.EntitiesRemoved {
+		if r.EntitiesRemoved == nil {
+			r.EntitiesRemoved = make(map[string]int)
+		}
+		r.EntitiesRemoved[id] += n
+	}
+}
+
+func newLowMapReport(lowmaps map[ChunkPos][]byte) *LowMapReport {
+	r := &LowMapReport{Chunks: len(lowmaps), MinY: 255}
+	defer func() {
+		if r.MinY > r.MaxY {
+			r.MinY = 0
+		}
+	}()
+	for _, lowmap := range lowmaps {
+		for _, y := range lowmap[:256] {
+			if y == 255 {
+				r.EmptyColumns++
+				continue
+			}
+			if int(y) < r.MinY {
+				r.MinY = int(y)
+			}
+			if int(y) > r.MaxY {
+				r.MaxY = int(y)
+			}
+		}
+	}
+	return r
+}
+
+func writeReport(path string, reports []*WorldReport) error {
+	if reports == nil {
+		reports = []*WorldReport{}
+	}
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/fs"
 	"log"
 	"os"
@@ -17,7 +18,7 @@ type DirSource struct {
 func NewDirSource(dir string) *DirSource {
 	return &DirSource{
 		dir:     dir,
-		overlay: NewOverlayFs(afero.NewBasePathFs(afero.NewOsFs(), dir)),
+		overlay: NewOverlayFs(afero.NewBasePathFs(afero.NewOsFs(), dir), newChangesFs(dir, memBudget)),
 	}
 }
 
@@ -30,76 +31,149 @@ func (s *DirSource) Fs() afero.Fs {
 }
 
 func (s *DirSource) Save() error {
-	if s.overlay.IsChanged() {
-		var err error
-		var out string
-		if *overwrite {
-			out, err = os.MkdirTemp("", "world")
-			defer func(path string) {
-				err := os.RemoveAll(path)
-				if err != nil {
-					log.Println(err)
-				}
-			}(out)
-		} else {
-			out = s.dir + *suffix
-			if err = os.RemoveAll(out); err != nil {
-				return err
-			}
-			err = os.Mkdir(out, 0666)
+	if !s.overlay.IsChanged() {
+		return nil
+	}
+	if *overwrite {
+		return s.saveInPlace()
+	}
+	return s.saveCopy()
+}
+
+// saveInPlace applies only the changes and the removals to the source folder.
+// The original files are kept in a backup folder next to it until all changes
+// are applied, and restored if the save fails or is interrupted.
+func (s *DirSource) saveInPlace() error {
+	j, err := s.journal()
+	if err != nil {
+		return err
+	}
+
+	if err := s.apply(j); err != nil {
+		if rollbackErr := j.rollback(); rollbackErr != nil {
+			return fmt.Errorf("%s save: %w, rollback: %v", s.dir, err, rollbackErr)
 		}
-		out = filepath.Clean(out)
+		return fmt.Errorf("%s save: %w", s.dir, err)
+	}
+	if err := j.commit(); err != nil {
+		return err
+	}
+	log.Println("Overwrited dir", s.dir)
+	return nil
+}
+
+// journal writes the journal of the changes before they are applied.
+func (s *DirSource) journal() (*journal, error) {
+	written, removed, err := s.overlay.Changes()
+	if err != nil {
+		return nil, err
+	}
+
+	j := newJournal(s.dir)
+	j.Backup = filepath.Join(filepath.Dir(j.Target), "."+filepath.Base(j.Target)+".trim-backup")
+	j.Removed = removed
+	for _, path := range written {
+		info, err := s.overlay.Stat(path)
 		if err != nil {
+			return nil, err
+		}
+		// A path of another type is removed first and doesn't count as replaced
+		original, err := os.Lstat(filepath.Join(s.dir, path))
+		existed := err == nil && original.IsDir() == info.IsDir()
+		j.Written = append(j.Written, journalEntry{Path: path, Existed: existed, Dir: info.IsDir()})
+	}
+	if err := os.RemoveAll(j.Backup); err != nil {
+		return nil, err
+	}
+	if err := j.save(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// apply moves the removed and replaced files to the backup and writes the
+// changed files.
+func (s *DirSource) apply(j *journal) error {
+	moveToBackup := func(path string) error {
+		if err := os.MkdirAll(filepath.Dir(j.backup(path)), 0755); err != nil {
 			return err
 		}
+		return os.Rename(filepath.Join(s.dir, path), j.backup(path))
+	}
 
-		err = afero.Walk(s.overlay, "", func(path string, info fs.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if s.overlay.IsRemoved(path) != nil {
-				return nil
-			}
-			dest := filepath.Join(out, path)
-			if info.IsDir() {
-				if dest != out {
-					return os.Mkdir(dest, 0666)
-				}
-				return nil
-			}
-			file, err := afero.ReadFile(s.overlay, path)
-			if err != nil {
+	for _, path := range j.Removed {
+		if _, err := os.Lstat(filepath.Join(s.dir, path)); err != nil {
+			continue
+		}
+		if err := moveToBackup(path); err != nil {
+			return err
+		}
+	}
+	for _, e := range j.Written {
+		dest := filepath.Join(s.dir, e.Path)
+		if e.Dir {
+			if err := os.MkdirAll(dest, 0755); err != nil {
 				return err
 			}
-			return os.WriteFile(dest, file, 0666)
-		})
+			continue
+		}
+		info, err := s.overlay.Stat(e.Path)
 		if err != nil {
 			return err
 		}
-
-		if *overwrite {
-			stat, err := os.Stat(s.dir)
-			if err != nil {
-				return err
-			}
-			mode := stat.Mode()
-			if err := os.RemoveAll(s.dir); err != nil {
-				return err
-			}
-			if err = os.Rename(out, s.dir); err != nil {
-				return err
-			}
-			if err = os.Chmod(s.dir, mode); err != nil {
+		tmp, err := writeTemp(s.overlay, e.Path, dest, s.overlay.Perm(e.Path, info))
+		if err != nil {
+			return err
+		}
+		if e.Existed {
+			if err := moveToBackup(e.Path); err != nil {
 				return err
 			}
-			log.Println("Overwrited dir", s.dir)
-		} else {
-			log.Println("Created dir", out)
+		}
+		if err := os.Rename(tmp, dest); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (s *DirSource) Close() error {
+// saveCopy writes the optimized world next to the source. Unchanged files are
+// cloned or copied from the source, hard linked with -link.
+func (s *DirSource) saveCopy() error {
+	written, _, err := s.overlay.Changes()
+	if err != nil {
+		return err
+	}
+	changed := make(map[string]bool, len(written))
+	for _, path := range written {
+		changed[path] = true
+	}
+
+	out := filepath.Clean(s.dir + *suffix)
+	if err = os.RemoveAll(out); err != nil {
+		return err
+	}
+	err = afero.Walk(s.overlay, "", func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(out, path)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(dest, info.Mode().Perm()|0700)
+		case changed[filepath.Clean(path)]:
+			return writeFile(s.overlay, path, dest, s.overlay.Perm(path, info))
+		default:
+			return copyFile(filepath.Join(s.dir, path), dest, info.Mode().Perm(), *hardLink)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("Created dir", out)
 	return nil
 }
+
+func (s *DirSource) Close() error {
+	return s.overlay.Close()
+}
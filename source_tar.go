@@ -0,0 +1,281 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+)
+
+// archiveExtensions are the file extensions of supported world archives
+var archiveExtensions = []string{".zip", ".tar", ".tar.gz", ".tgz", ".tar.zst", ".tzst"}
+
+// archiveExtension returns the extension of a world archive, "" for other
+// files.
+func archiveExtension(file string) string {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(file, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// NewArchiveSource opens the zip or tar archive, nil for other files.
+func NewArchiveSource(file string) Source {
+	switch archiveExtension(file) {
+	case "":
+		return nil
+	case ".zip":
+		return NewZipSource(file)
+	}
+	return NewTarSource(file)
+}
+
+// TarSource is a tar archive, optionally compressed with gzip or zstd. The
+// archive is extracted to a temporary folder next to it and written back in
+// the same format.
+type TarSource struct {
+	file    string
+	ext     string
+	dir     string
+	overlay *OverlayFs
+}
+
+func NewTarSource(file string) *TarSource {
+	s := &TarSource{
+		file: file,
+		ext:  archiveExtension(file),
+	}
+	dir, err := makeTempDir(filepath.Dir(filepath.Clean(file)), "."+filepath.Base(file)+".*.trim-extract")
+	if err != nil {
+		fatal(fmt.Errorf("open tar file %s %w", file, err))
+	}
+	s.dir = dir
+	files := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	if err := s.extract(files); err != nil {
+		fatal(fmt.Errorf("open tar file %s %w", file, err))
+	}
+	s.overlay = NewOverlayFs(afero.NewReadOnlyFs(files), newChangesFs(file, memBudget))
+	return s
+}
+
+// extract writes the files of the archive to the file system.
+func (s *TarSource) extract(files afero.Fs) error {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch s.ext {
+	case ".tar.gz", ".tgz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case ".tar.zst", ".tzst":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	// Folders get their times once their files are written
+	dirTimes := make(map[string]time.Time)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := filepath.Clean(strings.TrimPrefix(filepath.FromSlash(header.Name), string(filepath.Separator)))
+		if name == "." {
+			continue
+		}
+		if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s outside the archive", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := files.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			dirTimes[name] = header.ModTime
+			continue
+		case tar.TypeReg:
+			if err := files.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+			out, err := files.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", header.Name, err)
+			}
+		default:
+			log.Println(s.file, "skip", header.Name, "of unsupported type")
+			continue
+		}
+		if err := files.Chmod(name, header.FileInfo().Mode().Perm()); err != nil {
+			return err
+		}
+		if err := files.Chtimes(name, header.ModTime, header.ModTime); err != nil {
+			return err
+		}
+	}
+	for name, modTime := range dirTimes {
+		if err := files.Chtimes(name, modTime, modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *TarSource) Name() string {
+	return s.file
+}
+
+func (s *TarSource) Fs() afero.Fs {
+	return s.overlay
+}
+
+func (s *TarSource) Save() error {
+	if s.overlay.IsChanged() {
+		var outFile *os.File
+		var err error
+		var j *journal
+		if *overwrite {
+			j = newJournal(s.file)
+			j.Temp = tempPath(j.Target)
+			if err = j.save(); err != nil {
+				return err
+			}
+			outFile, err = os.Create(j.Temp)
+		} else {
+			barename := strings.TrimSuffix(s.file, s.ext)
+			outFile, err = os.Create(barename + *suffix + s.ext)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.write(outFile)
+		if err == nil {
+			err = outFile.Sync()
+		}
+		if closeErr := outFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(outFile.Name())
+			if j != nil {
+				_ = j.cleanup()
+			}
+			return err
+		}
+		if *overwrite {
+			if err := replaceFile(outFile.Name(), s.file); err != nil {
+				return err
+			}
+			if err := j.commit(); err != nil {
+				return err
+			}
+			log.Println("Saved file", s.file)
+		} else {
+			log.Println("Saved file", outFile.Name())
+		}
+	}
+	return nil
+}
+
+// write writes the files of the overlay as a tar archive compressed like the
+// source.
+func (s *TarSource) write(w io.Writer) error {
+	var compressor io.WriteCloser
+	switch s.ext {
+	case ".tar.gz", ".tgz":
+		compressor = gzip.NewWriter(w)
+	case ".tar.zst", ".tzst":
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		compressor = zw
+	}
+	if compressor != nil {
+		w = compressor
+	}
+
+	tw := tar.NewWriter(w)
+	err := afero.Walk(s.overlay, "", func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return fmt.Errorf("getting info for file %s: %w", info.Name(), err)
+		}
+		header.Name = filepath.ToSlash(filepath.Clean(path))
+		if header.Name == "." {
+			return nil
+		}
+		// Changed files may be in memory or spilled to disk
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Mode = int64(s.overlay.Perm(path, info))
+		}
+		if err := tw.WriteHeader(header); err != nil || info.IsDir() {
+			return err
+		}
+
+		file, err := s.overlay.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if closeErr := tw.Close(); err == nil {
+		err = closeErr
+	}
+	if compressor != nil {
+		if closeErr := compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *TarSource) Close() error {
+	err := s.overlay.Close()
+	if removeErr := removeTempDir(s.dir); err == nil {
+		err = removeErr
+	}
+	return err
+}
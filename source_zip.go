@@ -29,7 +29,7 @@ func NewZipSource(file string) *ZipSource {
 	s := &ZipSource{
 		z:       z,
 		file:    file,
-		overlay: NewOverlayFs(zipfs.New(&z.Reader)),
+		overlay: NewOverlayFs(zipfs.New(&z.Reader), newChangesFs(file, memBudget)),
 	}
 	return s
 }
@@ -46,8 +46,14 @@ func (s *ZipSource) Save() error {
 	if s.overlay.IsChanged() {
 		var outFile *os.File
 		var err error
+		var j *journal
 		if *overwrite {
-			outFile, err = os.CreateTemp("", "world*.zip")
+			j = newJournal(s.file)
+			j.Temp = tempPath(j.Target)
+			if err = j.save(); err != nil {
+				return err
+			}
+			outFile, err = os.Create(j.Temp)
 		} else {
 			split := strings.Split(s.file, ".")
 			barename := strings.Join(split[:len(split)-1], ".")
@@ -61,9 +67,6 @@ func (s *ZipSource) Save() error {
 			if err != nil {
 				return err
 			}
-			if s.overlay.IsRemoved(path) != nil {
-				return nil
-			}
 			header, err := kpzip.FileInfoHeader(info)
 			if err != nil {
 				return fmt.Errorf("getting info for file %s: %w", info.Name(), err)
@@ -93,25 +96,30 @@ func (s *ZipSource) Save() error {
 			}
 			return nil
 		})
-		_ = zw.Close()
-		_ = outFile.Close()
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = outFile.Sync()
+		}
+		if closeErr := outFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = s.Close()
+		}
 		if err != nil {
 			_ = os.Remove(outFile.Name())
-			return err
-		}
-		if err := s.Close(); err != nil {
+			if j != nil {
+				_ = j.cleanup()
+			}
 			return err
 		}
 		if *overwrite {
-			stat, err := os.Stat(s.file)
-			if err != nil {
+			if err := replaceFile(outFile.Name(), s.file); err != nil {
 				return err
 			}
-			mode := stat.Mode()
-			if err = os.Rename(outFile.Name(), s.file); err != nil {
-				return err
-			}
-			if err = os.Chmod(s.file, mode); err != nil {
+			if err := j.commit(); err != nil {
 				return err
 			}
 			log.Println("Saved file", s.file)
@@ -127,5 +135,8 @@ func (s *ZipSource) Close() (err error) {
 		err = s.z.Close()
 		s.z = nil
 	}
+	if closeErr := s.overlay.Close(); err == nil {
+		err = closeErr
+	}
 	return
 }
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// tempDirs are the temporary folders of spilled and extracted files, removed
+// on exit
+var tempDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+// makeTempDir creates a temporary folder removed by removeTempDirs.
+func makeTempDir(parent, pattern string) (string, error) {
+	dir, err := os.MkdirTemp(parent, pattern)
+	if err != nil {
+		return "", err
+	}
+	tempDirs.Lock()
+	tempDirs.dirs[dir] = true
+	tempDirs.Unlock()
+	return dir, nil
+}
+
+// removeTempDir removes the temporary folder.
+func removeTempDir(dir string) error {
+	tempDirs.Lock()
+	delete(tempDirs.dirs, dir)
+	tempDirs.Unlock()
+	return os.RemoveAll(dir)
+}
+
+// removeTempDirs removes all temporary folders.
+func removeTempDirs() {
+	tempDirs.Lock()
+	defer tempDirs.Unlock()
+	for dir := range tempDirs.dirs {
+		_ = os.RemoveAll(dir)
+		delete(tempDirs.dirs, dir)
+	}
+}
+
+// newChangesFs returns the file system for the changes of the world at the
+// path: memory only without a budget, else a spill file system with its
+// temporary folder next to the world.
+func newChangesFs(path string, budget uint64) afero.Fs {
+	if budget == 0 {
+		return afero.NewMemMapFs()
+	}
+	return newSpillFs(filepath.Dir(filepath.Clean(path)), "."+filepath.Base(path)+".*.trim-spill", budget)
+}
+
+// spillFs keeps files in memory until their total size exceeds the budget,
+// then moves files closed after writing to a temporary folder on disk.
+//
+// Folders are only kept in memory. A spilled file leaves an empty placeholder
+// in memory, so folder listings stay complete.
+type spillFs struct {
+	mem     afero.Fs
+	parent  string
+	pattern string
+	budget  uint64
+
+	mu      sync.Mutex
+	dir     string
+	disk    afero.Fs
+	used    uint64
+	sizes   map[string]uint64
+	spilled map[string]bool
+}
+
+func newSpillFs(parent, pattern string, budget uint64) *spillFs {
+	return &spillFs{
+		mem:     afero.NewMemMapFs(),
+		parent:  parent,
+		pattern: pattern,
+		budget:  budget,
+		sizes:   make(map[string]uint64),
+		spilled: make(map[string]bool),
+	}
+}
+
+func (s *spillFs) Name() string {
+	return "spillFs"
+}
+
+// isSpilled reports whether the file is stored on disk.
+func (s *spillFs) isSpilled(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spilled[filepath.Clean(name)]
+}
+
+func (s *spillFs) Create(name string) (afero.File, error) {
+	return s.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+}
+
+func (s *spillFs) Mkdir(name string, perm os.FileMode) error {
+	return s.mem.Mkdir(name, perm)
+}
+
+func (s *spillFs) MkdirAll(path string, perm os.FileMode) error {
+	return s.mem.MkdirAll(path, perm)
+}
+
+func (s *spillFs) Open(name string) (afero.File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (s *spillFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if s.isSpilled(name) {
+		return s.disk.OpenFile(name, flag, perm)
+	}
+	f, err := s.mem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return &spillDir{File: f, fs: s, name: filepath.Clean(name)}, nil
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return &spillFile{File: f, fs: s, name: filepath.Clean(name)}, nil
+	}
+	return f, nil
+}
+
+func (s *spillFs) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = filepath.Clean(name)
+	if err := s.mem.Remove(name); err != nil {
+		return err
+	}
+	s.forget(name)
+	if s.spilled[name] {
+		delete(s.spilled, name)
+		return s.disk.Remove(name)
+	}
+	return nil
+}
+
+func (s *spillFs) RemoveAll(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path = filepath.Clean(path)
+	if err := s.mem.RemoveAll(path); err != nil {
+		return err
+	}
+	for name := range s.sizes {
+		if isSubPath(name, path) {
+			s.forget(name)
+		}
+	}
+	for name := range s.spilled {
+		if isSubPath(name, path) {
+			delete(s.spilled, name)
+		}
+	}
+	if s.disk != nil {
+		return s.disk.RemoveAll(path)
+	}
+	return nil
+}
+
+func (s *spillFs) Rename(oldname, newname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	if err := s.mem.Rename(oldname, newname); err != nil {
+		return err
+	}
+	for name := range s.sizes {
+		if isSubPath(name, newname) {
+			s.forget(name)
+		}
+	}
+	for name := range s.spilled {
+		if isSubPath(name, newname) {
+			delete(s.spilled, name)
+		}
+	}
+	sizes := make(map[string]uint64)
+	for name, size := range s.sizes {
+		if isSubPath(name, oldname) {
+			s.forget(name)
+			sizes[newname+strings.TrimPrefix(name, oldname)] = size
+		}
+	}
+	for name, size := range sizes {
+		s.sizes[name] = size
+		s.used += size
+	}
+	moved := false
+	for name := range s.spilled {
+		if isSubPath(name, oldname) {
+			delete(s.spilled, name)
+			s.spilled[newname+strings.TrimPrefix(name, oldname)] = true
+			moved = true
+		}
+	}
+	if !moved {
+		return nil
+	}
+	_ = s.disk.RemoveAll(newname)
+	if err := s.disk.MkdirAll(filepath.Dir(newname), 0755); err != nil {
+		return err
+	}
+	return s.disk.Rename(oldname, newname)
+}
+
+func (s *spillFs) Stat(name string) (os.FileInfo, error) {
+	if s.isSpilled(name) {
+		return s.disk.Stat(name)
+	}
+	return s.mem.Stat(name)
+}
+
+func (s *spillFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	info, err := s.Stat(name)
+	return info, false, err
+}
+
+func (s *spillFs) Chmod(name string, mode os.FileMode) error {
+	if s.isSpilled(name) {
+		return s.disk.Chmod(name, mode)
+	}
+	return s.mem.Chmod(name, mode)
+}
+
+func (s *spillFs) Chown(name string, uid, gid int) error {
+	if s.isSpilled(name) {
+		return s.disk.Chown(name, uid, gid)
+	}
+	return s.mem.Chown(name, uid, gid)
+}
+
+func (s *spillFs) Chtimes(name string, atime, mtime time.Time) error {
+	if s.isSpilled(name) {
+		return s.disk.Chtimes(name, atime, mtime)
+	}
+	return s.mem.Chtimes(name, atime, mtime)
+}
+
+// Close removes the temporary folder.
+func (s *spillFs) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir == "" {
+		return nil
+	}
+	err := removeTempDir(s.dir)
+	s.dir, s.disk = "", nil
+	s.spilled = make(map[string]bool)
+	return err
+}
+
+// forget stops counting the memory of the file.
+func (s *spillFs) forget(name string) {
+	s.used -= s.sizes[name]
+	delete(s.sizes, name)
+}
+
+// closed counts the memory of the file written in memory and spills it if
+// the budget is exceeded.
+func (s *spillFs) closed(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spilled[name] {
+		return nil
+	}
+	info, err := s.mem.Stat(name)
+	if err != nil {
+		// Removed while open
+		return nil
+	}
+	s.forget(name)
+	s.sizes[name] = uint64(info.Size())
+	s.used += uint64(info.Size())
+	if s.used <= s.budget {
+		return nil
+	}
+	return s.spill(name, info)
+}
+
+// spill moves the file from memory to the temporary folder.
+func (s *spillFs) spill(name string, info os.FileInfo) error {
+	if s.disk == nil {
+		dir, err := makeTempDir(s.parent, s.pattern)
+		if err != nil {
+			return err
+		}
+		s.dir = dir
+		s.disk = afero.NewBasePathFs(afero.NewOsFs(), dir)
+	}
+	if err := s.disk.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	if err := copyFs(s.mem, s.disk, name, info.Mode().Perm()); err != nil {
+		return err
+	}
+	// The permissions of a created file are masked by the umask
+	if err := s.disk.Chmod(name, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := s.disk.Chtimes(name, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	placeholder, err := s.mem.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if err := placeholder.Close(); err != nil {
+		return err
+	}
+	s.forget(name)
+	s.spilled[name] = true
+	return nil
+}
+
+// copyFs copies the file from one file system to the other.
+func copyFs(src, dst afero.Fs, name string, perm os.FileMode) error {
+	in, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dst.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// isSubPath reports whether the path is the folder or inside it.
+func isSubPath(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// spillFile is a file written in memory, counted against the budget once
+// closed.
+type spillFile struct {
+	afero.File
+	fs   *spillFs
+	name string
+}
+
+func (f *spillFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return f.fs.closed(f.name)
+}
+
+// spillDir lists the spilled files of a folder with their info on disk.
+type spillDir struct {
+	afero.File
+	fs   *spillFs
+	name string
+}
+
+func (d *spillDir) Readdir(count int) ([]os.FileInfo, error) {
+	list, err := d.File.Readdir(count)
+	for i, info := range list {
+		path := filepath.Join(d.name, info.Name())
+		if d.fs.isSpilled(path) {
+			if stat, statErr := d.fs.Stat(path); statErr == nil {
+				list[i] = stat
+			}
+		}
+	}
+	return list, err
+}
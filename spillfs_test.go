@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// checkBudget checks the files counted in memory and the spilled files.
+func checkBudget(t *testing.T, fs *spillFs, step string, sizes map[string]uint64, spilled ...string) {
+	t.Helper()
+	var used uint64
+	for _, size := range sizes {
+		used += size
+	}
+	if fs.used != used || !reflect.DeepEqual(fs.sizes, sizes) {
+		t.Errorf("after %s: %d bytes used by %v, want %d by %v", step, fs.used, fs.sizes, used, sizes)
+	}
+	want := make(map[string]bool)
+	for _, name := range spilled {
+		want[filepath.FromSlash(name)] = true
+	}
+	if !reflect.DeepEqual(fs.spilled, want) {
+		t.Errorf("after %s: spilled %v, want %v", step, fs.spilled, want)
+	}
+}
+
+func TestSpillFs_Budget(t *testing.T) {
+	fs := newSpillFs(t.TempDir(), ".w.*.trim-spill", 10)
+	defer fs.Close()
+	for _, err := range []error{
+		fs.MkdirAll("d/sub", 0755),
+		afero.WriteFile(fs, "m", []byte("12345"), 0644),
+		afero.WriteFile(fs, "d/f", []byte("123456"), 0644),
+		afero.WriteFile(fs, "d/sub/g", []byte("1234567"), 0644),
+		afero.WriteFile(fs, "s", []byte("12345678"), 0644),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every file past the budget is spilled once closed
+	checkBudget(t, fs, "writing", map[string]uint64{"m": 5}, "d/f", "d/sub/g", "s")
+
+	if err := fs.Rename("d/sub/g", "d/g"); err != nil {
+		t.Fatal(err)
+	}
+	checkBudget(t, fs, "renaming d/sub/g", map[string]uint64{"m": 5}, "d/f", "d/g", "s")
+	if data, err := afero.ReadFile(fs, "d/g"); err != nil || string(data) != "1234567" {
+		t.Errorf("renamed spilled file %q, %v", data, err)
+	}
+
+	// Renaming a file in memory over a spilled file replaces it
+	if err := fs.Rename("m", "s"); err != nil {
+		t.Fatal(err)
+	}
+	checkBudget(t, fs, "renaming m over s", map[string]uint64{"s": 5}, "d/f", "d/g")
+	if data, err := afero.ReadFile(fs, "s"); err != nil || string(data) != "12345" {
+		t.Errorf("file renamed over a spilled file %q, %v", data, err)
+	}
+
+	if err := fs.Remove("d/f"); err != nil {
+		t.Fatal(err)
+	}
+	checkBudget(t, fs, "removing d/f", map[string]uint64{"s": 5}, "d/g")
+	if _, err := os.Stat(filepath.Join(fs.dir, "d/f")); !os.IsNotExist(err) {
+		t.Errorf("removed spilled file left on disk: %v", err)
+	}
+
+	if err := fs.RemoveAll("d"); err != nil {
+		t.Fatal(err)
+	}
+	checkBudget(t, fs, "removing d", map[string]uint64{"s": 5})
+	if _, err := os.Stat(filepath.Join(fs.dir, "d")); !os.IsNotExist(err) {
+		t.Errorf("removed spilled folder left on disk: %v", err)
+	}
+
+	if err := fs.Remove("s"); err != nil {
+		t.Fatal(err)
+	}
+	checkBudget(t, fs, "removing s", map[string]uint64{})
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mc-world-trimmer/chunk"
+
+	"github.com/spf13/afero"
+)
+
+// WorldStats counts the blocks, entities and tile entities of a world.
+type WorldStats struct {
+	Source     string            `json:"source"`
+	World      string            `json:"world"`
+	Dimensions []*DimensionStats `json:"dimensions"`
+}
+
+type DimensionStats struct {
+	Dimension   string `json:"dimension"`
+	RegionFiles int    `json:"region_files"`
+	RegionBytes int64  `json:"region_bytes"`
+	Chunks      int    `json:"chunks"`
+	// EmptyChunks and EmptySections would be removed by the optimizer
+	EmptyChunks   int `json:"empty_chunks"`
+	Sections      int `json:"sections"`
+	EmptySections int `json:"empty_sections"`
+	// Blocks by "id:data" for 1.8 chunks and by name for 1.13+ chunks,
+	// counted in the stored sections only
+	Blocks       map[string]*BlockStats `json:"blocks"`
+	Entities     map[string]int         `json:"entities"`
+	TileEntities map[string]int         `json:"tile_entities"`
+}
+
+type BlockStats struct {
+	Count int64         `json:"count"`
+	ByY   map[int]int64 `json:"by_y"`
+}
+
+func (s *DimensionStats) addBlock(name string, y int, count int64) {
+	b := s.Blocks[name]
+	if b == nil {
+		b = &BlockStats{ByY: make(map[int]int64)}
+		s.Blocks[name] = b
+	}
+	b.Count += count
+	b.ByY[y] += count
+}
+
+// blockCounter counts the blocks of the chunks of a region file.
+type blockCounter struct {
+	stats *DimensionStats
+	// blocks_1_8_8 counts the blocks of 1.8 chunks by id<<4|data and Y
+	blocks_1_8_8 map[uint16]*[256]int64
+}
+
+func newBlockCounter(dimension string) *blockCounter {
+	return &blockCounter{
+		stats:        newDimensionStats(dimension),
+		blocks_1_8_8: make(map[uint16]*[256]int64),
+	}
+}
+
+func newDimensionStats(dimension string) *DimensionStats {
+	return &DimensionStats{
+		Dimension:    dimension,
+		Blocks:       make(map[string]*BlockStats),
+		Entities:     make(map[string]int),
+		TileEntities: make(map[string]int),
+	}
+}
+
+func (b *blockCounter) visit(pos ChunkPos, c chunk.Chunk) error {
+	var entities, tileEntities []string
+	var sections int
+	var err error
+	switch c := c.(type) {
+	case *chunk.Chunk_1_8_8:
+		for _, section := range c.Sections {
+			for y := int(section.Y) << 4; y < int(section.Y)<<4+16; y++ {
+				for z := 0; z < 16; z++ {
+					for x := 0; x < 16; x++ {
+						id, data := c.GetType(x, y, z)
+						key := uint16(id)<<4 | uint16(data)
+						counts := b.blocks_1_8_8[key]
+						if counts == nil {
+							counts = new([256]int64)
+							b.blocks_1_8_8[key] = counts
+						}
+						counts[y]++
+					}
+				}
+			}
+		}
+		sections = len(c.Sections)
+		entities, tileEntities, err = c.EntityIDs()
+	case *chunk.Chunk_1_13:
+		for _, section := range c.Sections {
+			for y := int(section.Y) << 4; y < int(section.Y)<<4+16; y++ {
+				counts := make(map[string]int64)
+				for z := 0; z < 16; z++ {
+					for x := 0; x < 16; x++ {
+						counts[c.GetBlock(x, y, z)]++
+					}
+				}
+				for name, count := range counts {
+					b.stats.addBlock(name, y, count)
+				}
+			}
+		}
+		sections = len(c.Sections)
+		entities, tileEntities, err = c.EntityIDs()
+	}
+	if err != nil {
+		return err
+	}
+	for _, id := range entities {
+		b.stats.Entities[id]++
+	}
+	for _, id := range tileEntities {
+		b.stats.TileEntities[id]++
+	}
+
+	b.stats.Chunks++
+	b.stats.Sections += sections
+	if c.IsEmpty() {
+		b.stats.EmptyChunks++
+		b.stats.EmptySections += sections
+	} else {
+		b.stats.EmptySections += c.Optimize()
+	}
+	return nil
+}
+
+// finish moves the counts of 1.8 blocks to the stats.
+func (b *blockCounter) finish() *DimensionStats {
+	for key, counts := range b.blocks_1_8_8 {
+		name := fmt.Sprintf("%d:%d", key>>4, key&15)
+		for y, count := range counts {
+			if count > 0 {
+				b.stats.addBlock(name, y, count)
+			}
+		}
+	}
+	return b.stats
+}
+
+// entityCounter counts the entities of the chunks of an entities folder
+type entityCounter map[string]int
+
+func (e entityCounter) visit(pos ChunkPos, sector []byte) error {
+	c, err := chunk.LoadEntities(sector)
+	if err != nil {
+		return err
+	}
+	ids, err := c.EntityIDs()
+	for _, id := range ids {
+		e[id]++
+	}
+	return err
+}
+
+// collectStats counts the blocks and entities of every dimension of the world.
+func collectStats(fs afero.Fs, dir string, workers int) (*WorldStats, error) {
+	stats := &WorldStats{World: dir, Dimensions: []*DimensionStats{}}
+	for _, dim := range dimensions {
+		regionDir := filepath.Join(dir, dim, "region")
+		if exists, err := afero.DirExists(fs, regionDir); err != nil {
+			return nil, err
+		} else if !exists {
+			continue
+		}
+
+		dimStats := newDimensionStats(dim)
+		files, err := afero.ReadDir(fs, regionDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if _, ok := regionOrigin(f.Name()); ok && strings.HasSuffix(f.Name(), ".mca") {
+				dimStats.RegionFiles++
+				dimStats.RegionBytes += f.Size()
+			}
+		}
+
+		err = walkChunks(fs, regionDir, workers, func() chunkVisitor {
+			return newBlockCounter(dim)
+		}, func(v chunkVisitor) {
+			dimStats.add(v.(*blockCounter).finish())
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = walkRegions(fs, filepath.Join(dir, dim, "entities"), workers, func() regionVisitor {
+			return make(entityCounter)
+		}, func(v regionVisitor) {
+			for id, count := range v.(entityCounter) {
+				dimStats.Entities[id] += count
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		stats.Dimensions = append(stats.Dimensions, dimStats)
+	}
+	return stats, nil
+}
+
+func (s *DimensionStats) add(other *DimensionStats) {
+	s.Chunks += other.Chunks
+	s.EmptyChunks += other.EmptyChunks
+	s.Sections += other.Sections
+	s.EmptySections += other.EmptySections
+	for name, b := range other.Blocks {
+		for y, count := range b.ByY {
+			s.addBlock(name, y, count)
+		}
+	}
+	for id, count := range other.Entities {
+		s.Entities[id] += count
+	}
+	for id, count := range other.TileEntities {
+		s.TileEntities[id] += count
+	}
+}
+
+// writeStatsCSV writes a row per block and Y level, per entity and tile
+// entity type and per chunk count.
+func writeStatsCSV(w io.Writer, stats []*WorldStats) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"source", "world", "dimension", "kind", "id", "y", "count"})
+	for _, world := range stats {
+		for _, dim := range world.Dimensions {
+			row := func(kind, id, y string, count int64) {
+				out.Write([]string{world.Source, world.World, dim.Dimension, kind, id, y, strconv.FormatInt(count, 10)})
+			}
+			row("summary", "region_files", "", int64(dim.RegionFiles))
+			row("summary", "region_bytes", "", dim.RegionBytes)
+			row("summary", "chunks", "", int64(dim.Chunks))
+			row("summary", "empty_chunks", "", int64(dim.EmptyChunks))
+			row("summary", "sections", "", int64(dim.Sections))
+			row("summary", "empty_sections", "", int64(dim.EmptySections))
+			for _, name := range sortedKeys(dim.Blocks) {
+				b := dim.Blocks[name]
+				ys := make([]int, 0, len(b.ByY))
+				for y := range b.ByY {
+					ys = append(ys, y)
+				}
+				sort.Ints(ys)
+				for _, y := range ys {
+					row("block", name, strconv.Itoa(y), b.ByY[y])
+				}
+			}
+			for _, id := range sortedKeys(dim.Entities) {
+				row("entity", id, "", int64(dim.Entities[id]))
+			}
+			for _, id := range sortedKeys(dim.TileEntities) {
+				row("tile_entity", id, "", int64(dim.TileEntities[id]))
+			}
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statsCommand counts blocks, entities and tile entities of worlds.
+func statsCommand(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	format := flags.String("format", "csv", "Output format, csv or json")
+	output := flags.String("out", "", "Write to the `file` instead of the standard output")
+	recursive := flags.Bool("r", false, "Recursive search for worlds")
+	workers := flags.Int("j", runtime.NumCPU(), "Number of region files read in parallel")
+	flags.Usage = func() {
+		w := flags.Output()
+		base := filepath.Base(os.Args[0])
+		fmt.Fprintln(w, "Usage:")
+		fmt.Fprintln(w, " ", base, "stats [options] path")
+		fmt.Fprintln(w, "Examples:")
+		fmt.Fprintln(w, " ", base, "stats world > blocks.csv")
+		fmt.Fprintln(w, " ", base, "stats -r -format json -out stats.json .")
+		fmt.Fprintln(w, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return
+	}
+	if *format != "csv" && *format != "json" {
+		log.Fatalln("unknown format", *format)
+	}
+
+	handleInterrupt()
+
+	path := strings.Join(flags.Args(), " ")
+	source := NewArchiveSource(path)
+	if source != nil {
+		*recursive = true
+	} else {
+		source = NewDirSource(path)
+	}
+	defer source.Close()
+
+	worlds := []string{""}
+	if *recursive {
+		dirs, err := findWorldDirs(source.Fs())
+		if err != nil {
+			fatal(err)
+		}
+		worlds = dirs
+	}
+	stats := []*WorldStats{}
+	for _, dir := range worlds {
+		if ok, err := isWorldDir(source.Fs(), dir); err != nil {
+			fatal(err)
+		} else if !ok {
+			continue
+		}
+		log.Println(source.Name(), []string{dir, "stats..."})
+		world, err := collectStats(source.Fs(), dir, *workers)
+		if err != nil {
+			fatal(err)
+		}
+		world.Source = source.Name()
+		stats = append(stats, world)
+	}
+	if len(stats) == 0 {
+		log.Println("No worlds found in", path)
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	var err error
+	if *format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(stats)
+	} else {
+		err = writeStatsCSV(w, stats)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"mc-world-trimmer/chunk"
+
+	"github.com/Tnze/go-mc/save/region"
+	"github.com/spf13/afero"
+)
+
+// readRegion calls fn with every chunk sector of the region file.
+func readRegion(fs afero.Fs, path string, fn func(cx, cz int, sector []byte) error) error {
+	open, err := fs.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s region file read: %w", path, err)
+	}
+	defer open.Close()
+	rg, err := region.Load(open)
+	if err != nil {
+		return fmt.Errorf("%s region load: %w", path, err)
+	}
+	for cx := 0; cx < 32; cx++ {
+		for cz := 0; cz < 32; cz++ {
+			if !rg.ExistSector(cx, cz) {
+				continue
+			}
+			sector, err := rg.ReadSector(cx, cz)
+			if err != nil {
+				return fmt.Errorf("%s read sector %d,%d: %w", path, cx, cz, err)
+			}
+			if err := fn(cx, cz, sector); err != nil {
+				return fmt.Errorf("%s read chunk %d,%d: %w", path, cx, cz, err)
+			}
+		}
+	}
+	return nil
+}
+
+// regionVisitor collects data of the chunk sectors of a region file.
+type regionVisitor interface {
+	visit(pos ChunkPos, sector []byte) error
+}
+
+// chunkVisitor collects data of the chunks of a region file.
+type chunkVisitor interface {
+	visit(pos ChunkPos, c chunk.Chunk) error
+}
+
+// walkRegions reads the region files in the folder in parallel. Every region
+// file gets a new visitor, done is called with the visitors in the order of
+// the files.
+func walkRegions(fs afero.Fs, dir string, workers int, newVisitor func() regionVisitor, done func(v regionVisitor)) error {
+	if exists, err := afero.DirExists(fs, dir); err != nil || !exists {
+		return err
+	}
+	files, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		return err
+	}
+
+	visitors := make([]regionVisitor, len(files))
+	return forEachOrdered(workers, len(files), func(i int) error {
+		origin, ok := regionOrigin(files[i].Name())
+		if !ok || !strings.HasSuffix(files[i].Name(), ".mca") {
+			return nil
+		}
+		v := newVisitor()
+		visitors[i] = v
+		return readRegion(fs, filepath.Join(dir, files[i].Name()), func(cx, cz int, sector []byte) error {
+			return v.visit(ChunkPos{origin.X + cx, origin.Z + cz}, sector)
+		})
+	}, func(i int) {
+		if visitors[i] != nil {
+			done(visitors[i])
+			visitors[i] = nil
+		}
+	})
+}
+
+// chunkLoader loads the sectors visited by walkRegions.
+type chunkLoader struct {
+	chunks chunkVisitor
+}
+
+func (l chunkLoader) visit(pos ChunkPos, sector []byte) error {
+	c, err := chunk.Load(sector)
+	if err != nil {
+		return err
+	}
+	return l.chunks.visit(pos, c)
+}
+
+// walkChunks is walkRegions loading the chunks.
+func walkChunks(fs afero.Fs, dir string, workers int, newVisitor func() chunkVisitor, done func(v chunkVisitor)) error {
+	return walkRegions(fs, dir, workers, func() regionVisitor {
+		return chunkLoader{newVisitor()}
+	}, func(v regionVisitor) {
+		done(v.(chunkLoader).chunks)
+	})
+}
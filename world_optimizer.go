@@ -2,26 +2,82 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"math"
+	"os"
 	"path/filepath"
-	"sort"
 	"strings"
+	"time"
 
 	"mc-world-trimmer/chunk"
+	"mc-world-trimmer/lowmap"
 
 	"github.com/Tnze/go-mc/save/region"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/afero"
 )
 
+// dimensions are the folders of a world holding the region files of the
+// overworld, the nether and the end
+var dimensions = []string{"", "DIM-1", "DIM1"}
+
 type WorldOptimizer struct {
 	Source            Source
 	AnyWorldFound     bool
 	ComputeHeightMaps bool
-	ComputeLowMaps    bool
+	// CheckHeightMaps reports the 1.8 chunks whose stored height map differs
+	// from the computed one.
+	CheckHeightMaps bool
+	ComputeLowMaps  bool
+	// LowMapVersion is the format of low maps, 1 or 2. LowMapCompression
+	// compresses version 2 low maps.
+	LowMapVersion     int
+	LowMapCompression lowmap.Compression
+	// ComputeLight recomputes the sky and block light of 1.8 chunks.
+	ComputeLight bool
+	// StripLight removes the sky and block light of 1.8 chunks. Only servers
+	// relighting chunks on load can read such worlds.
+	StripLight bool
+	// EntityRules select the entities removed from 1.8 chunks. Chunks left
+	// without entities may be removed as empty.
+	EntityRules *chunk.EntityRules
+	// CleanTileEntities removes tile entities of 1.8 chunks that don't
+	// match their blocks, lie outside the chunk or share a position.
+	CleanTileEntities bool
+	// BlockRemap substitutes blocks of 1.8 chunks before they are trimmed.
+	BlockRemap *chunk.BlockRemap
+
+	// Workers is the number of region files processed concurrently.
+	// Values below 1 mean a single worker.
+	Workers int
+
+	// MinInhabitedTime removes chunks players spent less ticks in, unless
+	// they have tile entities or lie within SpawnRadius chunks of the spawn
+	// in the overworld.
+	// KeepMargin chunks around the kept ones are kept too. Zero disables it.
+	MinInhabitedTime int64
+	SpawnRadius      int
+	KeepMargin       int
+
+	// Crop removes all chunks outside the area, in every dimension. A radius
+	// around the spawn crops only the overworld.
+	Crop *CropArea
+	// Mask keeps or removes the chunks it lists, in every dimension.
+	Mask *ChunkMask
+	// WorldGuardPath is a WorldGuard regions.yml file or the folder with
+	// the regions of worlds by their names. Only the chunks touched by the
+	// regions and WorldGuardPadding chunks around them are kept.
+	WorldGuardPath    string
+	WorldGuardPadding int
+
+	// DryRun lists the chunks removed by Crop, Mask and MinInhabitedTime.
+	DryRun bool
+
+	// Reports has a record for every optimized world.
+	Reports   []*WorldReport
+	report    *WorldReport
+	dimReport *DimensionReport
 }
 
 func (o *WorldOptimizer) Process(recursive bool) error {
@@ -39,39 +95,50 @@ func (o *WorldOptimizer) Process(recursive bool) error {
 }
 
 func (o *WorldOptimizer) checkWorldCandidate(dir string) error {
-	if ok, err := afero.IsDir(o.fs(), dir); err != nil {
-		return err
-	} else if !ok {
-		return nil
-	}
-	readdir, err := afero.ReadDir(o.fs(), dir)
-	if err != nil {
+	if ok, err := isWorldDir(o.fs(), dir); err != nil || !ok {
 		return err
 	}
+	return o.optimize(dir)
+}
 
-	levelFound := false
-	regionFound := false
-	for _, file := range readdir {
-		switch file.Name() {
-		case "level.dat":
-			levelFound = true
-		case "region":
-			if file.IsDir() {
-				regionFound = true
-			}
-		}
+// isWorldDir reports whether the dir holds a world: level.dat and region
+// files of any dimension.
+func isWorldDir(fs afero.Fs, dir string) (bool, error) {
+	if ok, err := afero.IsDir(fs, dir); err != nil || !ok {
+		return false, err
 	}
-	if levelFound && regionFound {
-		return o.optimize(dir)
+	if ok, err := afero.Exists(fs, filepath.Join(dir, "level.dat")); err != nil || !ok {
+		return false, err
 	}
-	return nil
+	for _, dim := range dimensions {
+		if ok, err := afero.DirExists(fs, filepath.Join(dir, dim, "region")); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
 }
 
 func (o *WorldOptimizer) optimize(dir string) error {
 	o.AnyWorldFound = true
 	o.log(dir, "optimize...")
-	if err := o.processChunks(dir); err != nil {
-		return err
+	o.report = &WorldReport{Source: o.Source.Name(), World: dir, DryRun: o.DryRun, DeletedFiles: []string{}}
+	o.Reports = append(o.Reports, o.report)
+	defer o.report.finish(time.Now())
+	for _, dim := range dimensions {
+		dimDir := filepath.Join(dir, dim)
+		if ok, err := afero.DirExists(o.fs(), filepath.Join(dimDir, "region")); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if err := o.processChunks(dir, dimDir); err != nil {
+			return err
+		}
+		if !o.ComputeLowMaps && dim != "" {
+			if err := o.removeFileIfExists(filepath.Join(dimDir, "lowmap.bin")); err != nil {
+				return err
+			}
+		}
 	}
 	if err := o.deleteUselessFiles(dir); err != nil {
 		return err
@@ -100,192 +167,595 @@ func (o *WorldOptimizer) deleteUselessFiles(dir string) error {
 	return nil
 }
 
-func (o *WorldOptimizer) processChunks(dir string) error {
-	var worldSize uint64
-	var newWorldSize uint64
+func (o *WorldOptimizer) processChunks(worldDir, dir string) error {
+	o.dimReport = &DimensionReport{Dimension: filepath.Base(dir)}
+	if dir == worldDir {
+		o.dimReport.Dimension = ""
+	}
+	o.report.Dimensions = append(o.report.Dimensions, o.dimReport)
+	defer o.dimReport.finish(time.Now())
+
+	// Since 1.17 entities are stored apart from the terrain, a chunk with
+	// entities is not empty even if its terrain is
+	entities, err := o.scanEntities(dir)
+	if err != nil {
+		return err
+	}
+
+	keep, err := o.keepFilters(worldDir, dir)
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Base(dir)
+	dim := &dimension{
+		dir:      dir,
+		hasSky:   dir == worldDir || base != "DIM-1" && base != "DIM1",
+		entities: entities,
+		keep:     keep,
+	}
 
 	lowmaps := make(map[ChunkPos][]byte)
+	removed := make(map[ChunkPos]bool)
+	err = o.processRegions(dir, "region", func(path string, file os.FileInfo) (*regionResult, error) {
+		return o.processRegion(path, file, dim)
+	}, func(res *regionResult) {
+		for pos, lowmap := range res.lowmaps {
+			lowmaps[pos] = lowmap
+		}
+		for _, pos := range res.removedChunks {
+			removed[pos] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Entities and points of interest follow the terrain chunks
+	for _, folder := range []string{"entities", "poi"} {
+		if exists, err := afero.DirExists(o.fs(), filepath.Join(dir, folder)); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+		err = o.processRegions(dir, folder, func(path string, file os.FileInfo) (*regionResult, error) {
+			return o.processStorageRegion(path, file, folder, removed)
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.ComputeLowMaps {
+		o.dimReport.LowMap = newLowMapReport(lowmaps)
+		if err = o.saveLowMap(dir, lowmaps); err != nil {
+			return err
+		}
+	}
 
-	regionDirPath := filepath.Join(dir, "region")
+	return nil
+}
+
+// processRegions processes the region files of a folder of the world in
+// parallel. merge is called with the results in the order of the files.
+func (o *WorldOptimizer) processRegions(
+	dir, folder string,
+	process func(path string, file os.FileInfo) (*regionResult, error),
+	merge func(res *regionResult),
+) error {
+	var worldSize uint64
+	var newWorldSize uint64
+
+	regionDirPath := filepath.Join(dir, folder)
 	regionFiles, err := afero.ReadDir(o.fs(), regionDirPath)
 	if err != nil {
 		return err
 	}
-	for _, file := range regionFiles {
+	report := &FolderReport{Folder: folder}
+	o.dimReport.Folders = append(o.dimReport.Folders, report)
+
+	results := make([]*regionResult, len(regionFiles))
+	err = forEachOrdered(o.Workers, len(regionFiles), func(i int) (err error) {
+		results[i], err = process(filepath.Join(regionDirPath, regionFiles[i].Name()), regionFiles[i])
+		return
+	}, func(i int) {
+		file, res := regionFiles[i], results[i]
+		results[i] = nil
 		worldSize += uint64(file.Size())
-		path := filepath.Join(regionDirPath, file.Name())
-		if strings.HasSuffix(path, ".mcr") {
-			if exists, err := afero.Exists(o.fs(), path[:len(path)-4]+".mca"); err != nil {
-				return err
-			} else if !exists {
-				continue
+		newWorldSize += res.newSize
+		report.add(file, res)
+		if merge != nil {
+			merge(res)
+		}
+		if *verbose {
+			name := file.Name()
+			if folder != "region" {
+				name = filepath.Join(folder, name)
 			}
-			if err := o.fs().Remove(path); err != nil {
-				return err
+			switch {
+			case res.removed:
+				o.log(dir, name, "removed", humanize.Bytes(uint64(file.Size())))
+			case res.updated:
+				o.log(dir, name, "updated",
+					humanize.Bytes(uint64(file.Size())), "to", humanize.Bytes(res.newSize),
+				)
+			}
+			for _, te := range res.tileEntitiesRemoved {
+				o.log(dir, name, "tile entity", te.Id, fmt.Sprintf("at %d,%d,%d", te.X, te.Y, te.Z), "removed:", te.Reason)
+			}
+			if res.blocksRemapped > 0 {
+				o.log(dir, name, "blocks remapped", fmt.Sprint(res.blocksRemapped))
+			}
+			if n := countEntities(res.entitiesRemoved); n > 0 {
+				o.log(dir, name, "entities removed", fmt.Sprint(n))
+			}
+			if res.lightRemoved > 0 {
+				o.log(dir, name, "light stripped", humanize.Bytes(uint64(res.lightRemoved)))
+			}
+			for _, m := range res.heightMapMismatches {
+				o.log(dir, name, fmt.Sprintf("chunk %d,%d", m.pos.X, m.pos.Z), "height map differs in", fmt.Sprint(m.columns), "columns")
 			}
-			continue
 		}
-		if !strings.HasSuffix(path, ".mca") {
-			continue
+		if !*verbose && len(res.tileEntitiesRemoved) > 0 {
+			o.log(dir, file.Name(), "tile entities removed", fmt.Sprint(len(res.tileEntitiesRemoved)))
+		}
+		if !*verbose && len(res.heightMapMismatches) > 0 {
+			o.log(dir, file.Name(), "chunks with stale height maps", fmt.Sprint(len(res.heightMapMismatches)))
+		}
+		for _, f := range res.filtered {
+			o.log(dir, file.Name(), fmt.Sprintf("chunk %d,%d", f.pos.X, f.pos.Z), "removed by", f.by)
 		}
+	})
+	if err != nil {
+		return err
+	}
 
-		open, err := o.fs().Open(path)
-		if err != nil {
-			return fmt.Errorf("%s region file read: %w", path, err)
+	if worldSize != newWorldSize {
+		what := "regions"
+		if folder != "region" {
+			what = folder
 		}
-		rg, err := region.Load(open)
-		if err != nil {
-			return fmt.Errorf("%s region load: %w", path, err)
+		o.log(
+			dir, what+" optimized",
+			humanize.Bytes(worldSize), "=>", humanize.Bytes(newWorldSize),
+			fmt.Sprintf("(%v%%)", math.Round(-(100-100*float64(newWorldSize)/float64(worldSize)))),
+		)
+	}
+	return nil
+}
+
+// regionResult is the outcome of processing a single region file.
+type regionResult struct {
+	newSize uint64
+	updated bool
+	removed bool
+	lowmaps map[ChunkPos][]byte
+	// removedChunks holds the absolute positions of the removed chunks
+	removedChunks []ChunkPos
+	// filtered holds the chunks removed by filters, listed on dry runs
+	filtered []filteredChunk
+
+	chunks          int
+	chunksRemoved   int
+	chunksUpdated   int
+	sectionsRemoved int
+	// lightRemoved is the number of bytes of light data removed
+	lightRemoved int
+	// entitiesRemoved is the number of removed entities by ID
+	entitiesRemoved map[string]int
+	// tileEntitiesRemoved lists the removed orphaned tile entities
+	tileEntitiesRemoved []chunk.RemovedTileEntity
+	blocksRemapped      int
+	// heightMapMismatches lists the chunks with stale height maps
+	heightMapMismatches []heightMapMismatch
+}
+
+type filteredChunk struct {
+	pos ChunkPos
+	by  string
+}
+
+type heightMapMismatch struct {
+	pos     ChunkPos
+	columns int
+}
+
+// dimension holds the state shared by the region files of a dimension.
+type dimension struct {
+	dir    string
+	hasSky bool
+	// entities holds the chunks with entities in the entities folder
+	entities map[ChunkPos]bool
+	keep     chunkFilters
+}
+
+func (o *WorldOptimizer) processRegion(path string, file os.FileInfo, dim *dimension) (*regionResult, error) {
+	res := &regionResult{}
+	if strings.HasSuffix(path, ".mcr") {
+		if exists, err := afero.Exists(o.fs(), path[:len(path)-4]+".mca"); err != nil {
+			return nil, err
+		} else if !exists {
+			res.newSize = uint64(file.Size())
+			return res, nil
 		}
+		res.removed = true
+		return res, o.fs().Remove(path)
+	}
+	if !strings.HasSuffix(path, ".mca") {
+		res.newSize = uint64(file.Size())
+		return res, nil
+	}
+	origin, originKnown := regionOrigin(file.Name())
 
-		removedChunks := make(map[ChunkPos]bool)
-		updatedChunks := make(map[ChunkPos]*chunk.Chunk_1_8_8)
-		numChunks := 0
-		for cx := 0; cx < 32; cx++ {
-			for cz := 0; cz < 32; cz++ {
-				if !rg.ExistSector(cx, cz) {
-					continue
-				}
+	open, err := o.fs().Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s region file read: %w", path, err)
+	}
+	defer open.Close()
+	rg, err := region.Load(open)
+	if err != nil {
+		return nil, fmt.Errorf("%s region load: %w", path, err)
+	}
+
+	if o.ComputeLowMaps {
+		res.lowmaps = make(map[ChunkPos][]byte)
+	}
+	removedChunks := make(map[ChunkPos]bool)
+	updatedChunks := make(map[ChunkPos]chunk.Chunk)
+	// lit holds the chunks to relight by their absolute positions
+	lit := make(map[ChunkPos]litChunk)
+	numChunks := 0
+	for cx := 0; cx < 32; cx++ {
+		for cz := 0; cz < 32; cz++ {
+			if !rg.ExistSector(cx, cz) {
+				continue
+			}
+
+			sector, err := rg.ReadSector(cx, cz)
+			if err != nil {
+				return nil, fmt.Errorf("%s read sector %d,%d: %w", path, cx, cz, err)
+			}
+			c, err := chunk.Load(sector)
+			if err != nil {
+				return nil, fmt.Errorf("%s read chunk %d,%d: %w", path, cx, cz, err)
+			}
+
+			numChunks++
+
+			abs := ChunkPos{origin.X + cx, origin.Z + cz}
+			if !originKnown {
+				abs = storedPos(c, abs)
+			}
+			isEmpty := func() bool {
+				return c.IsEmpty() && !dim.entities[abs]
+			}
+			remove := func() {
+				removedChunks[ChunkPos{cx, cz}] = true
+				res.removedChunks = append(res.removedChunks, abs)
+			}
 
-				var c chunk.Chunk_1_8_8
-				if sector, err := rg.ReadSector(cx, cz); err != nil {
-					return fmt.Errorf("%s read sector %d,%d: %w", path, cx, cz, err)
-				} else if err = c.Load(sector); err != nil {
-					return fmt.Errorf("%s read chunk %d,%d: %w", path, cx, cz, err)
+			updated := false
+			pos := storedPos(c, abs)
+			if by := dim.keep.removedBy(pos); by != "" {
+				remove()
+				if o.DryRun {
+					res.filtered = append(res.filtered, filteredChunk{pos, by})
 				}
+				continue
+			}
 
-				numChunks++
+			if c, ok := c.(*chunk.Chunk_1_8_8); ok && o.BlockRemap != nil {
+				if n := c.Remap(o.BlockRemap); n > 0 {
+					updated = true
+					res.blocksRemapped += n
+				}
+			}
 
-				updated := false
-				if c.IsEmpty() {
-					removedChunks[ChunkPos{cx, cz}] = true
-					continue
-				} else if c.Optimize() {
-					if c.IsEmpty() {
-						removedChunks[ChunkPos{cx, cz}] = true
-						continue
-					} else {
-						updated = true
+			if c, ok := c.(*chunk.Chunk_1_8_8); ok && o.EntityRules != nil {
+				removed, err := c.FilterEntities(o.EntityRules)
+				if err != nil {
+					return nil, fmt.Errorf("%s filter entities %d,%d: %w", path, cx, cz, err)
+				}
+				if len(removed) > 0 {
+					updated = true
+					if res.entitiesRemoved == nil {
+						res.entitiesRemoved = make(map[string]int)
+					}
+					for id, n := range removed {
+						res.entitiesRemoved[id] += n
 					}
 				}
+			}
 
-				if o.ComputeHeightMaps && c.ComputeHeightMap() {
+			if c, ok := c.(*chunk.Chunk_1_8_8); ok && o.CleanTileEntities {
+				removed, err := c.CleanTileEntities()
+				if err != nil {
+					return nil, fmt.Errorf("%s clean tile entities %d,%d: %w", path, cx, cz, err)
+				}
+				if len(removed) > 0 {
 					updated = true
+					res.tileEntitiesRemoved = append(res.tileEntitiesRemoved, removed...)
 				}
+			}
 
-				if o.ComputeLowMaps {
-					lowmaps[ChunkPos{int(c.XPos), int(c.ZPos)}] = c.ComputeLowMap()
+			if isEmpty() {
+				remove()
+				continue
+			} else if n := c.Optimize(); n > 0 {
+				if isEmpty() {
+					remove()
+					continue
+				} else {
+					updated = true
+					res.sectionsRemoved += n
 				}
+			}
 
-				if updated {
-					updatedChunks[ChunkPos{cx, cz}] = &c
+			if c, ok := c.(*chunk.Chunk_1_8_8); ok && o.CheckHeightMaps {
+				if columns := c.HeightMapMismatches(); len(columns) > 0 {
+					res.heightMapMismatches = append(res.heightMapMismatches, heightMapMismatch{abs, len(columns)})
 				}
 			}
-		}
 
-		if len(updatedChunks) > 0 || numChunks > len(removedChunks) && len(removedChunks) > 0 {
-			newFile, err := o.fs().Create(path)
-			if err != nil {
-				return fmt.Errorf("%s create file: %w", path, err)
+			if o.ComputeHeightMaps && c.ComputeHeightMap() {
+				updated = true
 			}
-			replace, err := region.CreateWriter(newFile)
-			if err != nil {
-				return fmt.Errorf("%s create region: %w", path, err)
+
+			if c, ok := c.(*chunk.Chunk_1_8_8); ok && o.StripLight {
+				if removed, changed := c.StripLight(); changed {
+					updated = true
+					res.lightRemoved += removed
+				}
 			}
 
-			for cx := 0; cx < 32; cx++ {
-				for cz := 0; cz < 32; cz++ {
-					if !rg.ExistSector(cx, cz) {
-						continue
-					}
-					if _, ok := removedChunks[ChunkPos{cx, cz}]; ok {
-						continue
-					}
+			if o.ComputeLowMaps {
+				res.lowmaps[storedPos(c, abs)] = c.ComputeLowMap()
+			}
 
-					if c, ok := updatedChunks[ChunkPos{cx, cz}]; ok {
-						if data, err := c.Save(); err != nil {
-							return fmt.Errorf("%s write chunk %d,%d: %w", path, cx, cz, err)
-						} else if err := replace.WriteSector(cx, cz, data); err != nil {
-							return fmt.Errorf("%s write sector %d,%d: %w", path, cx, cz, err)
-						}
-					} else {
-						if sector, err := rg.ReadSector(cx, cz); err != nil {
-							return fmt.Errorf("%s read sector %d,%d: %w", path, cx, cz, err)
-						} else if err := replace.WriteSector(cx, cz, sector); err != nil {
-							return fmt.Errorf("%s write sector %d,%d: %w", path, cx, cz, err)
+			if updated {
+				updatedChunks[ChunkPos{cx, cz}] = c
+			}
+			if c, ok := c.(*chunk.Chunk_1_8_8); ok && o.ComputeLight {
+				lit[abs] = litChunk{ChunkPos{cx, cz}, c}
+			}
+		}
+	}
+
+	if len(lit) > 0 {
+		neighbours := o.newNeighbourLoader(dim)
+		defer neighbours.close()
+		for pos, l := range lit {
+			var around [3][3]*chunk.Chunk_1_8_8
+			for dx := -1; dx <= 1; dx++ {
+				for dz := -1; dz <= 1; dz++ {
+					npos := ChunkPos{pos.X + dx, pos.Z + dz}
+					if n, ok := lit[npos]; ok {
+						around[dx+1][dz+1] = n.chunk
+					} else if npos.X>>5 != pos.X>>5 || npos.Z>>5 != pos.Z>>5 {
+						if around[dx+1][dz+1], err = neighbours.load(npos); err != nil {
+							return nil, err
 						}
 					}
 				}
 			}
-			if err := replace.PadToFullSector(); err != nil {
-				return err
-			}
-			if err := replace.Close(); err != nil {
-				return err
-			}
-			stat, _ := newFile.Stat()
-			if *verbose {
-				o.log(dir, file.Name(), "updated",
-					humanize.Bytes(uint64(file.Size())), "to", humanize.Bytes(uint64(stat.Size())),
-				)
+			if l.chunk.Relight(around, dim.hasSky) {
+				updatedChunks[l.local] = l.chunk
 			}
-			newWorldSize += uint64(stat.Size())
-			_ = open.Close()
-			continue
 		}
+	}
 
-		_ = open.Close()
+	return res, o.writeRegion(path, file, open, rg, res, numChunks, removedChunks, updatedChunks)
+}
+
+// processStorageRegion trims a region file of the entities or poi folder.
+// Chunks are removed together with their terrain chunks or when they hold
+// nothing.
+func (o *WorldOptimizer) processStorageRegion(path string, file os.FileInfo, folder string, terrainRemoved map[ChunkPos]bool) (*regionResult, error) {
+	res := &regionResult{}
+	origin, originKnown := regionOrigin(file.Name())
+	if !strings.HasSuffix(path, ".mca") || !originKnown {
+		res.newSize = uint64(file.Size())
+		return res, nil
+	}
+
+	open, err := o.fs().Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s region file read: %w", path, err)
+	}
+	defer open.Close()
+	rg, err := region.Load(open)
+	if err != nil {
+		return nil, fmt.Errorf("%s region load: %w", path, err)
+	}
 
-		if numChunks == len(removedChunks) {
-			if *verbose {
-				o.log(dir, file.Name(), "removed", humanize.Bytes(uint64(file.Size())))
+	removedChunks := make(map[ChunkPos]bool)
+	numChunks := 0
+	for cx := 0; cx < 32; cx++ {
+		for cz := 0; cz < 32; cz++ {
+			if !rg.ExistSector(cx, cz) {
+				continue
 			}
-			if err := o.fs().Remove(path); err != nil {
-				return err
+			numChunks++
+
+			if terrainRemoved[ChunkPos{origin.X + cx, origin.Z + cz}] {
+				removedChunks[ChunkPos{cx, cz}] = true
+				continue
+			}
+
+			sector, err := rg.ReadSector(cx, cz)
+			if err != nil {
+				return nil, fmt.Errorf("%s read sector %d,%d: %w", path, cx, cz, err)
+			}
+			var empty bool
+			if folder == "entities" {
+				c, err := chunk.LoadEntities(sector)
+				if err != nil {
+					return nil, fmt.Errorf("%s read chunk %d,%d: %w", path, cx, cz, err)
+				}
+				empty = c.IsEmpty()
+			} else {
+				c, err := chunk.LoadPoi(sector)
+				if err != nil {
+					return nil, fmt.Errorf("%s read chunk %d,%d: %w", path, cx, cz, err)
+				}
+				empty = c.IsEmpty()
+			}
+			if empty {
+				removedChunks[ChunkPos{cx, cz}] = true
 			}
-			continue
 		}
+	}
 
-		newWorldSize += uint64(file.Size())
+	return res, o.writeRegion(path, file, open, rg, res, numChunks, removedChunks, nil)
+}
+
+// scanEntities returns the positions of chunks with entities stored in the
+// entities folder of the world.
+func (o *WorldOptimizer) scanEntities(dir string) (map[ChunkPos]bool, error) {
+	return o.scanRegions(dir, "entities", func(pos ChunkPos, sector []byte) (ChunkPos, bool, error) {
+		c, err := chunk.LoadEntities(sector)
+		if err != nil {
+			return pos, false, err
+		}
+		return pos, !c.IsEmpty(), nil
+	})
+}
+
+// storedPos returns the position stored in the chunk, or the given one
+// derived from the region file if the chunk has none.
+func storedPos(c chunk.Chunk, pos ChunkPos) ChunkPos {
+	if x, z, ok := c.Pos(); ok {
+		return ChunkPos{x, z}
 	}
+	return pos
+}
 
-	if worldSize != newWorldSize {
-		o.log(
-			dir, "regions optimized",
-			humanize.Bytes(worldSize), "=>", humanize.Bytes(newWorldSize),
-			fmt.Sprintf("(%v%%)", math.Round(-(100-100*float64(newWorldSize)/float64(worldSize)))),
-		)
+// scanRegions reads the chunks of a folder of the world in parallel and
+// returns the positions of the chunks matched by check. check is given the
+// position derived from the region file and returns the one to record.
+func (o *WorldOptimizer) scanRegions(dir, folder string, check func(pos ChunkPos, sector []byte) (ChunkPos, bool, error)) (map[ChunkPos]bool, error) {
+	matched := make(map[ChunkPos]bool)
+	regionDirPath := filepath.Join(dir, folder)
+	if exists, err := afero.DirExists(o.fs(), regionDirPath); err != nil || !exists {
+		return matched, err
+	}
+	files, err := afero.ReadDir(o.fs(), regionDirPath)
+	if err != nil {
+		return nil, err
 	}
 
-	if o.ComputeLowMaps {
-		if err = o.saveLowMap(dir, lowmaps); err != nil {
+	results := make([][]ChunkPos, len(files))
+	err = forEachOrdered(o.Workers, len(files), func(i int) error {
+		origin, ok := regionOrigin(files[i].Name())
+		if !ok || !strings.HasSuffix(files[i].Name(), ".mca") {
+			return nil
+		}
+		path := filepath.Join(regionDirPath, files[i].Name())
+		return readRegion(o.fs(), path, func(cx, cz int, sector []byte) error {
+			pos := ChunkPos{origin.X + cx, origin.Z + cz}
+			pos, ok, err := check(pos, sector)
+			if ok {
+				results[i] = append(results[i], pos)
+			}
+			return err
+		})
+	}, func(i int) {
+		for _, pos := range results[i] {
+			matched[pos] = true
+		}
+		results[i] = nil
+	})
+	return matched, err
+}
+
+// writeRegion rewrites the region file without the removed chunks and with
+// the updated ones, or removes it if no chunks are left.
+func (o *WorldOptimizer) writeRegion(
+	path string, file os.FileInfo, open afero.File, rg *region.Region, res *regionResult,
+	numChunks int, removedChunks map[ChunkPos]bool, updatedChunks map[ChunkPos]chunk.Chunk,
+) error {
+	res.chunks = numChunks
+	res.chunksRemoved = len(removedChunks)
+	res.chunksUpdated = len(updatedChunks)
+	if len(updatedChunks) > 0 || numChunks > len(removedChunks) && len(removedChunks) > 0 {
+		newFile, err := o.fs().Create(path)
+		if err != nil {
+			return fmt.Errorf("%s create file: %w", path, err)
+		}
+		replace, err := region.CreateWriter(newFile)
+		if err != nil {
+			return fmt.Errorf("%s create region: %w", path, err)
+		}
+
+		for cx := 0; cx < 32; cx++ {
+			for cz := 0; cz < 32; cz++ {
+				if !rg.ExistSector(cx, cz) {
+					continue
+				}
+				if _, ok := removedChunks[ChunkPos{cx, cz}]; ok {
+					continue
+				}
+
+				if c, ok := updatedChunks[ChunkPos{cx, cz}]; ok {
+					if data, err := c.Save(); err != nil {
+						return fmt.Errorf("%s write chunk %d,%d: %w", path, cx, cz, err)
+					} else if err := replace.WriteSector(cx, cz, data); err != nil {
+						return fmt.Errorf("%s write sector %d,%d: %w", path, cx, cz, err)
+					}
+				} else {
+					if sector, err := rg.ReadSector(cx, cz); err != nil {
+						return fmt.Errorf("%s read sector %d,%d: %w", path, cx, cz, err)
+					} else if err := replace.WriteSector(cx, cz, sector); err != nil {
+						return fmt.Errorf("%s write sector %d,%d: %w", path, cx, cz, err)
+					}
+				}
+			}
+		}
+		if err := replace.PadToFullSector(); err != nil {
 			return err
 		}
+		if err := replace.Close(); err != nil {
+			return err
+		}
+		stat, err := o.fs().Stat(path)
+		if err != nil {
+			return fmt.Errorf("%s stat: %w", path, err)
+		}
+		res.updated = true
+		res.newSize = uint64(stat.Size())
+		return nil
+	}
+
+	if numChunks == len(removedChunks) {
+		_ = open.Close()
+		res.removed = true
+		return o.fs().Remove(path)
 	}
 
+	res.newSize = uint64(file.Size())
 	return nil
 }
 
-func (o *WorldOptimizer) saveLowMap(dir string, lowmap map[ChunkPos][]byte) error {
-	sorted := make([]ChunkPos, 0, len(lowmap))
-	for pos := range lowmap {
-		sorted = append(sorted, pos)
+func (o *WorldOptimizer) saveLowMap(dir string, lowmaps map[ChunkPos][]byte) error {
+	dimension := lowmap.Overworld
+	switch filepath.Base(dir) {
+	case "DIM-1":
+		dimension = lowmap.Nether
+	case "DIM1":
+		dimension = lowmap.End
 	}
-	sort.Slice(sorted, func(i, j int) bool {
-		if sorted[i].Z == sorted[j].Z {
-			return sorted[i].X < sorted[j].X
+	m := lowmap.New(dimension)
+	m.Version = o.LowMapVersion
+	m.Compression = o.LowMapCompression
+	for pos, columns := range lowmaps {
+		if err := m.Set(pos.X, pos.Z, columns); err != nil {
+			return err
 		}
-		return sorted[i].Z < sorted[j].Z
-	})
-
-	buf := make([]byte, 0, 4+len(lowmap)*(8+len(lowmap[sorted[0]])))
-	buf = binary.BigEndian.AppendUint32(buf, uint32(len(lowmap)))
-	for _, pos := range sorted {
-		buf = binary.BigEndian.AppendUint32(buf, uint32(pos.X))
-		buf = binary.BigEndian.AppendUint32(buf, uint32(pos.Z))
 	}
-	for _, pos := range sorted {
-		buf = append(buf, lowmap[pos]...)
+	m.Sort()
+	buf, err := m.Encode()
+	if err != nil {
+		return fmt.Errorf("%s lowmap: %w", dir, err)
 	}
 
 	dest := filepath.Join(dir, "lowmap.bin")
@@ -311,6 +781,7 @@ func (o *WorldOptimizer) removeDirIfExists(dir string) error {
 		return err
 	} else if exists {
 		o.log(dir, "dir removed")
+		o.report.DeletedFiles = append(o.report.DeletedFiles, dir)
 		return o.fs().RemoveAll(dir)
 	}
 	return nil
@@ -321,6 +792,7 @@ func (o *WorldOptimizer) removeFileIfExists(file string) error {
 		return err
 	} else if exists {
 		o.log(file, "removed")
+		o.report.DeletedFiles = append(o.report.DeletedFiles, file)
 		return o.fs().Remove(file)
 	}
 	return nil
@@ -330,6 +802,15 @@ func (o *WorldOptimizer) fs() afero.Fs {
 	return o.Source.Fs()
 }
 
+// sourceFs returns the file system with the files as they were before the
+// optimization.
+func (o *WorldOptimizer) sourceFs() afero.Fs {
+	if overlay, ok := o.fs().(*OverlayFs); ok {
+		return overlay.Source()
+	}
+	return o.fs()
+}
+
 func (o *WorldOptimizer) log(args ...string) {
 	log.Println(o.Source.Name(), args)
 }
@@ -338,3 +819,14 @@ type ChunkPos struct {
 	X int
 	Z int
 }
+
+// regionOrigin returns the position of the first chunk of a region file
+// named like r.X.Z.mca
+func regionOrigin(name string) (ChunkPos, bool) {
+	var x, z int
+	var ext string
+	if n, _ := fmt.Sscanf(name, "r.%d.%d.%s", &x, &z, &ext); n != 3 {
+		return ChunkPos{}, false
+	}
+	return ChunkPos{x << 5, z << 5}, true
+}
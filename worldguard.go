@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// WorldGuardRegion is a region of the WorldGuard regions.yml file.
+type WorldGuardRegion struct {
+	Type   string
+	Min    worldGuardPoint
+	Max    worldGuardPoint
+	Points []worldGuardPoint
+}
+
+type worldGuardPoint struct {
+	X float64 `yaml:"x"`
+	Z float64 `yaml:"z"`
+}
+
+// LoadWorldGuardRegions reads the cuboid and polygon regions of a WorldGuard
+// regions.yml file. Global regions cover no chunks and are skipped.
+func LoadWorldGuardRegions(path string) (map[string]WorldGuardRegion, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Regions map[string]WorldGuardRegion
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	regions := make(map[string]WorldGuardRegion, len(file.Regions))
+	for name, region := range file.Regions {
+		switch region.Type {
+		case "cuboid":
+		case "poly2d":
+			if len(region.Points) < 3 {
+				return nil, fmt.Errorf("%s: region %s has less than 3 points", path, name)
+			}
+		case "global":
+			continue
+		default:
+			return nil, fmt.Errorf("%s: region %s has unknown type %s", path, name, region.Type)
+		}
+		regions[name] = region
+	}
+	return regions, nil
+}
+
+// WorldGuardMask returns the mask keeping the chunks touched by the regions
+// and padding chunks around them.
+func WorldGuardMask(regions map[string]WorldGuardRegion, padding int) *ChunkMask {
+	mask := &ChunkMask{Keep: true, Chunks: make(map[ChunkPos]bool)}
+	for _, region := range regions {
+		switch region.Type {
+		case "cuboid":
+			area := CropBlocks(
+				int(math.Floor(region.Min.X)), int(math.Floor(region.Min.Z)),
+				int(math.Floor(region.Max.X)), int(math.Floor(region.Max.Z)),
+			)
+			area.MinX -= padding
+			area.MinZ -= padding
+			area.MaxX += padding
+			area.MaxZ += padding
+			mask.Areas = append(mask.Areas, area)
+		case "poly2d":
+			for pos := range region.chunks() {
+				for x := pos.X - padding; x <= pos.X+padding; x++ {
+					for z := pos.Z - padding; z <= pos.Z+padding; z++ {
+						mask.Chunks[ChunkPos{x, z}] = true
+					}
+				}
+			}
+		}
+	}
+	return mask
+}
+
+// worldGuardWorld returns the name of the world WorldGuard uses for the
+// dimension folder dir of the world named name: Bukkit names the nether and
+// the end after the overworld with the _nether and _the_end suffixes.
+func worldGuardWorld(name, dir, worldDir string) string {
+	if dir == worldDir {
+		return name
+	}
+	suffix := "_the_end"
+	if filepath.Base(dir) == "DIM-1" {
+		suffix = "_nether"
+	}
+	// A Bukkit world folder of the nether or the end is named so already
+	if strings.HasSuffix(name, suffix) {
+		return name
+	}
+	return name + suffix
+}
+
+// chunks returns the chunks touched by the polygon.
+func (r *WorldGuardRegion) chunks() map[ChunkPos]bool {
+	// Points are blocks, a block covers one unit from its coordinates
+	points := make([]worldGuardPoint, len(r.Points))
+	minX, minZ := math.Inf(1), math.Inf(1)
+	maxX, maxZ := math.Inf(-1), math.Inf(-1)
+	for i, p := range r.Points {
+		points[i] = worldGuardPoint{math.Floor(p.X) + 0.5, math.Floor(p.Z) + 0.5}
+		minX, maxX = math.Min(minX, p.X), math.Max(maxX, p.X)
+		minZ, maxZ = math.Min(minZ, p.Z), math.Max(maxZ, p.Z)
+	}
+
+	chunks := make(map[ChunkPos]bool)
+	for cx := int(math.Floor(minX)) >> 4; cx <= int(math.Floor(maxX))>>4; cx++ {
+		for cz := int(math.Floor(minZ)) >> 4; cz <= int(math.Floor(maxZ))>>4; cz++ {
+			x0, z0 := float64(cx<<4), float64(cz<<4)
+			if polygonTouchesRect(points, x0, z0, x0+16, z0+16) {
+				chunks[ChunkPos{cx, cz}] = true
+			}
+		}
+	}
+	return chunks
+}
+
+// polygonTouchesRect reports whether the polygon and the rectangle overlap.
+func polygonTouchesRect(points []worldGuardPoint, x0, z0, x1, z1 float64) bool {
+	if polygonContains(points, (x0+x1)/2, (z0+z1)/2) {
+		return true
+	}
+	for i, a := range points {
+		b := points[(i+1)%len(points)]
+		if segmentTouchesRect(a, b, x0, z0, x1, z1) {
+			return true
+		}
+	}
+	return false
+}
+
+// polygonContains tests the point with the even-odd rule.
+func polygonContains(points []worldGuardPoint, x, z float64) bool {
+	inside := false
+	for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+		a, b := points[i], points[j]
+		if (a.Z > z) != (b.Z > z) && x < (b.X-a.X)*(z-a.Z)/(b.Z-a.Z)+a.X {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// segmentTouchesRect clips the segment by the rectangle (Liang-Barsky).
+func segmentTouchesRect(a, b worldGuardPoint, x0, z0, x1, z1 float64) bool {
+	dx, dz := b.X-a.X, b.Z-a.Z
+	t0, t1 := 0.0, 1.0
+	for _, edge := range [4][2]float64{
+		{-dx, a.X - x0}, {dx, x1 - a.X},
+		{-dz, a.Z - z0}, {dz, z1 - a.Z},
+	} {
+		p, q := edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				return false
+			}
+			continue
+		}
+		t := q / p
+		if p < 0 {
+			t0 = math.Max(t0, t)
+		} else {
+			t1 = math.Min(t1, t)
+		}
+		if t0 > t1 {
+			return false
+		}
+	}
+	return true
+}
+
+// worldGuardMask loads the mask of the dimension folder dir of the world from
+// WorldGuardPath, which is either a regions.yml file or the WorldGuard worlds
+// folder. A regions.yml file is for the overworld only, the nether and the
+// end are left whole. nil means no mask.
+func (o *WorldOptimizer) worldGuardMask(worldDir, dir string) (*ChunkMask, error) {
+	path := o.WorldGuardPath
+	if stat, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if stat.IsDir() {
+		name := filepath.Base(worldDir)
+		if worldDir == "" || worldDir == "." {
+			// The world is named after its folder, or its archive without
+			// the extension
+			name = filepath.Base(o.Source.Name())
+			if _, ok := o.Source.(*DirSource); !ok {
+				name = strings.TrimSuffix(name, archiveExtension(name))
+			}
+		}
+		path = filepath.Join(path, worldGuardWorld(name, dir, worldDir), "regions.yml")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			o.log(dir, "no WorldGuard regions in", path)
+			return nil, nil
+		}
+	} else if dir != worldDir {
+		o.log(dir, "WorldGuard regions of", path, "left out of the dimension")
+		return nil, nil
+	}
+
+	regions, err := LoadWorldGuardRegions(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("%s: no cuboid or polygon regions", path)
+	}
+	if *verbose {
+		o.log(dir, "WorldGuard regions loaded from", path)
+	}
+	return WorldGuardMask(regions, o.WorldGuardPadding), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testRegions = `regions:
+  spawn:
+    type: cuboid
+    min: {x: 0, y: 0, z: 0}
+    max: {x: 15, y: 255, z: 15}
+`
+
+func TestWorldGuardMask_Dimensions(t *testing.T) {
+	root := t.TempDir()
+	world := filepath.Join(root, "world")
+	for _, dim := range dimensions {
+		if err := os.MkdirAll(filepath.Join(world, dim, "region"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	worlds := filepath.Join(root, "worlds")
+	for _, name := range []string{"world", "world_nether"} {
+		if err := os.MkdirAll(filepath.Join(worlds, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(worlds, name, "regions.yml"), []byte(testRegions), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	source := NewDirSource(world)
+	defer source.Close()
+	for _, tc := range []struct {
+		path   string
+		masked map[string]bool
+	}{
+		// The end has no regions file
+		{worlds, map[string]bool{"": true, "DIM-1": true}},
+		// A single file is for the overworld
+		{filepath.Join(worlds, "world", "regions.yml"), map[string]bool{"": true}},
+	} {
+		o := &WorldOptimizer{Source: source, WorldGuardPath: tc.path}
+		for _, dim := range dimensions {
+			filters, err := o.keepFilters("", filepath.Join("", dim))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filters.removedBy(ChunkPos{10, 10}) != ""; got != tc.masked[dim] {
+				t.Errorf("%s: chunk outside the regions removed from %q: %v, want %v", tc.path, dim, got, tc.masked[dim])
+			}
+			if by := filters.removedBy(ChunkPos{0, 0}); by != "" {
+				t.Errorf("%s: chunk of the regions removed from %q by %s", tc.path, dim, by)
+			}
+		}
+	}
+}
+
+func TestWorldGuardWorld(t *testing.T) {
+	for _, tc := range []struct{ name, dir, worldDir, want string }{
+		{"world", "", "", "world"},
+		{"world", "DIM-1", "", "world_nether"},
+		{"world", "DIM1", "", "world_the_end"},
+		{"world_nether", "saves/world_nether/DIM-1", "saves/world_nether", "world_nether"},
+		{"world_the_end", "world_the_end/DIM1", "world_the_end", "world_the_end"},
+	} {
+		if got := worldGuardWorld(tc.name, tc.dir, tc.worldDir); got != tc.want {
+			t.Errorf("worldGuardWorld(%q, %q, %q) = %q, want %q", tc.name, tc.dir, tc.worldDir, got, tc.want)
+		}
+	}
+}